@@ -0,0 +1,376 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// archiveSeparator separates an archive from the path of a member inside it, as in
+// gitleaks reports, e.g. app.jar!BOOT-INF/classes/application.properties
+const archiveSeparator = "!"
+
+// maxMemberSize is the largest archive member that is read into memory
+const maxMemberSize = 512 << 20
+
+// zipExtensions are the extensions of zip-based archive formats
+var zipExtensions = []string{".zip", ".jar", ".war", ".ear", ".aar", ".apk", ".docx", ".xlsx", ".pptx", ".odt", ".ods", ".odp", ".epub", ".nupkg", ".whl", ".vsix"}
+
+// isZipName reports whether the file name has the extension of a zip-based format
+func isZipName(name string) bool {
+	return slices.Contains(zipExtensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// isArchiveName reports whether the file name has the extension of a supported
+// archive, or is a blob of an OCI image layout
+func isArchiveName(name string) bool {
+	return isZipName(name) || isTarName(name) || isOCIBlob(name)
+}
+
+// splitArchivePath splits the path of an archive member into the path of the
+// outermost archive and the path of the member inside it. Paths that do not point
+// into an archive are returned as they are, with an empty member.
+func splitArchivePath(file string) (archive, member string) {
+	for i := 0; i < len(file); i++ {
+		j := strings.Index(file[i:], archiveSeparator)
+		if j < 0 {
+			break
+		}
+		i += j
+		if isArchiveName(file[:i]) {
+			return file[:i], file[i+len(archiveSeparator):]
+		}
+	}
+	return file, ""
+}
+
+// memberEdit describes how an archive member changes
+type memberEdit struct {
+	content []byte // New content of the member, nil to keep it unchanged
+	remove  bool   // Whether to remove the member
+	note    []byte // Note to add next to the member, if any
+}
+
+// memberFunc returns the edit of an archive member with the given name and content
+type memberFunc func(name string, content []byte) (memberEdit, error)
+
+// rewriteArchive rewrites the members of an archive selected by wants, chosen by the
+// archive's name. It returns nil if nothing changed.
+func rewriteArchive(name string, buf []byte, wants func(member string) bool, edit memberFunc) ([]byte, error) {
+	switch {
+	case isZipName(name):
+		return rewriteZip(buf, wants, edit)
+	case isTarName(name), isOCIBlob(name):
+		return rewriteTar(buf, wants, edit)
+	default:
+		return nil, fmt.Errorf("unsupported archive: %s", name)
+	}
+}
+
+// walkArchive calls fn with the name and content of every regular member of an archive
+func walkArchive(name string, buf []byte, fn func(member string, content []byte) error) error {
+	switch {
+	case isZipName(name):
+		return walkZip(buf, fn)
+	case isTarName(name), isOCIBlob(name):
+		return walkTar(buf, fn)
+	default:
+		return fmt.Errorf("unsupported archive: %s", name)
+	}
+}
+
+// rewriteZip rewrites the members of a zip archive selected by wants. All other
+// members are copied with their compressed data, so order, timestamps and
+// compression methods are kept. Rewritten members keep their header as well, only
+// their sizes and checksum change.
+func rewriteZip(buf []byte, wants func(member string) bool, edit memberFunc) ([]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("error reading zip archive: %v", err)
+	}
+
+	names := make(map[string]bool, len(r.File))
+	for _, f := range r.File {
+		names[f.Name] = true
+	}
+
+	var out bytes.Buffer
+	w := zip.NewWriter(&out)
+	changed := false
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !wants(f.Name) {
+			if err := w.Copy(f); err != nil {
+				return nil, fmt.Errorf("error copying %s: %v", f.Name, err)
+			}
+			continue
+		}
+
+		content, err := readZipMember(f)
+		if err != nil {
+			return nil, err
+		}
+		e, err := edit(f.Name, content)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case e.remove:
+			changed = true
+		case e.content == nil:
+			if err := w.Copy(f); err != nil {
+				return nil, fmt.Errorf("error copying %s: %v", f.Name, err)
+			}
+		default:
+			changed = true
+			if err := writeZipMember(w, f.FileHeader, e.content); err != nil {
+				return nil, err
+			}
+		}
+
+		if e.note != nil {
+			changed = true
+			header := f.FileHeader
+			header.Name = freeName(f.Name+".masked", ".txt", names)
+			names[header.Name] = true
+			if err := writeZipMember(w, header, e.note); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+
+	if err := w.SetComment(r.Comment); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("error writing zip archive: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// walkZip calls fn with the name and content of every file of a zip archive
+func walkZip(buf []byte, fn func(member string, content []byte) error) error {
+	r, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return fmt.Errorf("error reading zip archive: %v", err)
+	}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		content, err := readZipMember(f)
+		if err != nil {
+			return err
+		}
+		if err := fn(f.Name, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readZipMember reads the uncompressed content of a zip archive member
+func readZipMember(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > maxMemberSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", f.Name, maxMemberSize)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", f.Name, err)
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(io.LimitReader(rc, maxMemberSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", f.Name, err)
+	}
+	if len(content) > maxMemberSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", f.Name, maxMemberSize)
+	}
+	return content, nil
+}
+
+// writeZipMember compresses the content with the method of the header and writes
+// it with the header as it is, so no extra fields are added or lost
+func writeZipMember(w *zip.Writer, header zip.FileHeader, content []byte) error {
+	var compressed bytes.Buffer
+	switch header.Method {
+	case zip.Store:
+		compressed.Write(content)
+	case zip.Deflate:
+		fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(content); err != nil {
+			return err
+		}
+		if err := fw.Close(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported compression method %d of %s", header.Method, header.Name)
+	}
+
+	header.Flags &^= 0x8 // sizes and checksum are known, no data descriptor needed
+	header.CRC32 = crc32.ChecksumIEEE(content)
+	header.CompressedSize64 = uint64(compressed.Len())
+	header.UncompressedSize64 = uint64(len(content))
+	header.Extra = stripZipExtra(header.Extra, 0x0001) // Zip64 sizes are rewritten as needed
+
+	fw, err := w.CreateRaw(&header)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", header.Name, err)
+	}
+	if _, err := fw.Write(compressed.Bytes()); err != nil {
+		return fmt.Errorf("error writing %s: %v", header.Name, err)
+	}
+	return nil
+}
+
+// stripZipExtra removes the extra field blocks with the given ID
+func stripZipExtra(extra []byte, id uint16) []byte {
+	var out []byte
+	for len(extra) >= 4 {
+		size := int(extra[2]) | int(extra[3])<<8
+		if 4+size > len(extra) {
+			break
+		}
+		if block := extra[:4+size]; uint16(extra[0])|uint16(extra[1])<<8 != id {
+			out = append(out, block...)
+		}
+		extra = extra[4+size:]
+	}
+	return append(out, extra...)
+}
+
+// freeName returns base+ext, or a numbered variant of it, that is not in use
+func freeName(base, ext string, used map[string]bool) string {
+	name := base + ext
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s.%d%s", base, i, ext)
+	}
+	return name
+}
+
+// hasMemberFindings reports whether any finding points into an archive
+func hasMemberFindings(findings []finding) bool {
+	for _, f := range findings {
+		if _, member := splitArchivePath(f.File); member != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleArchive masks the findings inside the members of an archive and repacks it
+func (m *Masker) HandleArchive(path string, findings ...finding) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	out, err := m.maskArchive(path, buf, findings)
+	if out != nil {
+		if err := m.RecreateFile(path, out); err != nil {
+			return fmt.Errorf("error recreating file: %v", err)
+		}
+	}
+	return err
+}
+
+// maskArchive masks the findings inside the members of an archive, given as the
+// path of the archive and its content. The File of each finding holds the path of
+// the member after the archive, as reported by the scanner. It returns the new
+// content of the archive, or nil if nothing changed, along with the errors of the
+// findings that could not be masked.
+func (m *Masker) maskArchive(path string, buf []byte, findings []finding) ([]byte, error) {
+	var errs []error
+	byMember := make(map[string][]finding)
+	for _, f := range findings {
+		_, member := splitArchivePath(f.File)
+		if member == "" {
+			errs = append(errs, fmt.Errorf("finding %s (%s) in archive %s has no member path", f.ID, f.RuleID, path))
+			continue
+		}
+		f.File = member
+		name, _ := splitArchivePath(member)
+		byMember[name] = append(byMember[name], f)
+	}
+
+	found := make(map[string]bool)
+	out, err := rewriteArchive(path, buf, func(name string) bool {
+		return len(byMember[name]) > 0
+	}, func(name string, content []byte) (memberEdit, error) {
+		found[name] = true
+		e, err := m.maskMember(path+archiveSeparator+name, content, byMember[name])
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return e, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error rewriting archive %s: %v", path, err)
+	}
+
+	for name, memberFindings := range byMember {
+		if !found[name] {
+			errs = append(errs, fmt.Errorf("archive %s has no member %s for %d finding(s)", path, name, len(memberFindings)))
+		}
+	}
+	return out, errors.Join(errs...)
+}
+
+// maskMember masks the findings of an archive member, routing it through the
+// archive, binary or text handling like a file on disk
+func (m *Masker) maskMember(path string, content []byte, findings []finding) (memberEdit, error) {
+	if isArchiveName(path) && hasMemberFindings(findings) {
+		out, err := m.maskArchive(path, content, findings)
+		return memberEdit{content: out}, err
+	}
+
+	enc := m.encodingFor(path, content)
+	for _, f := range findings {
+		if f.RuleID == "pkcs12-file" {
+			enc = encBinary
+		}
+	}
+
+	if enc == encBinary {
+		strategy := m.binaryStrategy(path, findings)
+		if strategy == BinaryKeep {
+			m.logger.Warning("Keeping binary member %s with %d finding(s) by policy", path, len(findings))
+			return memberEdit{}, nil
+		}
+		note := m.binaryNote(path, strategy, findings)
+		switch strategy {
+		case BinaryStub:
+			return memberEdit{content: note}, nil
+		case BinaryDelete:
+			return memberEdit{remove: true, note: note}, nil
+		default:
+			return memberEdit{content: []byte{}, note: note}, nil
+		}
+	}
+
+	text, err := enc.decode(content)
+	if err != nil {
+		return memberEdit{}, fmt.Errorf("error decoding %s: %v", path, err)
+	}
+	masked, maskErr := m.maskContent(text, path, findings...)
+	out, err := enc.encode(masked)
+	if err != nil {
+		return memberEdit{}, fmt.Errorf("error encoding %s: %v", path, err)
+	}
+	return memberEdit{content: out}, maskErr
+}
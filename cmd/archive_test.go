@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type zipMember struct {
+	name    string
+	method  uint16
+	content []byte
+}
+
+func buildZip(t *testing.T, members []zipMember) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i, m := range members {
+		fw, err := w.CreateHeader(&zip.FileHeader{
+			Name:     m.name,
+			Method:   m.method,
+			Modified: time.Date(2020, 1, 2, 3, 4, 5+i*2, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatalf("Failed to create zip member: %v", err)
+		}
+		if _, err := fw.Write(m.content); err != nil {
+			t.Fatalf("Failed to write zip member: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func readZip(t *testing.T, buf []byte) ([]*zip.File, map[string]string) {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatalf("Failed to read zip: %v", err)
+	}
+	contents := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", f.Name, err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", f.Name, err)
+		}
+		contents[f.Name] = string(content)
+	}
+	return r.File, contents
+}
+
+func TestMasker_HandleArchive_Zip(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	inner := buildZip(t, []zipMember{
+		{name: "secret.txt", method: zip.Store, content: []byte("token=inner-s3cr3t\n")},
+	})
+	archive := buildZip(t, []zipMember{
+		{name: "mimetype", method: zip.Store, content: []byte("application/java-archive")},
+		{name: "config/app.properties", method: zip.Deflate, content: []byte("db.user=admin\ndb.password=s3cr3t\n")},
+		{name: "lib/inner.jar", method: zip.Store, content: inner},
+		{name: "keys/client.p12", method: zip.Deflate, content: []byte{0x30, 0x82, 0x00, 0x01, 0xff}},
+		{name: "README", method: zip.Deflate, content: []byte("nothing to see\n")},
+	})
+	testFilePath := filepath.Join(tmpDir, "app.jar")
+	if err := os.WriteFile(testFilePath, archive, 0600); err != nil {
+		t.Fatalf("Failed to write test archive: %v", err)
+	}
+
+	findings := []finding{
+		{RuleID: "password", StartLine: 2, EndLine: 2, Secret: "s3cr3t", File: testFilePath + "!config/app.properties", ID: "id-1"},
+		{RuleID: "token", StartLine: 1, EndLine: 1, Secret: "inner-s3cr3t", File: testFilePath + "!lib/inner.jar!secret.txt", ID: "id-2"},
+		{RuleID: "pkcs12-file", File: testFilePath + "!keys/client.p12", ID: "id-3"},
+	}
+	masker := NewMasker(tmpDir, tmpDir, findings, MaskerOptions{PlaceholderMask: "<%[2]s>"}, Default())
+	if len(masker.findings) != 1 || len(masker.findings[testFilePath]) != 3 {
+		t.Fatalf("Expected all findings to be grouped by archive, got %v", masker.findings)
+	}
+	handler, err := masker.ParseFileType(testFilePath, masker.findings[testFilePath])
+	if err != nil {
+		t.Fatalf("ParseFileType failed: %v", err)
+	}
+	if err := handler(); err != nil {
+		t.Fatalf("HandleArchive failed: %v", err)
+	}
+
+	masked, err := os.ReadFile(testFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read masked archive: %v", err)
+	}
+	originalFiles, _ := readZip(t, archive)
+	files, contents := readZip(t, masked)
+
+	// Order, timestamps and methods are kept, the note follows its member
+	expectedNames := []string{"mimetype", "config/app.properties", "lib/inner.jar", "keys/client.p12", "keys/client.p12.masked.txt", "README"}
+	if len(files) != len(expectedNames) {
+		t.Fatalf("Expected %d members, got %d", len(expectedNames), len(files))
+	}
+	for i, name := range expectedNames {
+		if files[i].Name != name {
+			t.Errorf("Expected member %d to be %s, got %s", i, name, files[i].Name)
+		}
+	}
+	for i, j := range []int{0, 1, 2, 3, 5} {
+		if !files[j].Modified.Equal(originalFiles[i].Modified) || files[j].Method != originalFiles[i].Method {
+			t.Errorf("Expected %s to keep its timestamp and method", files[j].Name)
+		}
+	}
+
+	if expected := "db.user=admin\ndb.password=<password>\n"; contents["config/app.properties"] != expected {
+		t.Errorf("Expected masked properties %q, got %q", expected, contents["config/app.properties"])
+	}
+	if _, innerContents := readZip(t, []byte(contents["lib/inner.jar"])); innerContents["secret.txt"] != "token=<token>\n" {
+		t.Errorf("Expected masked nested member, got %q", innerContents["secret.txt"])
+	}
+	if contents["keys/client.p12"] != "" {
+		t.Errorf("Expected binary member to be emptied, got %q", contents["keys/client.p12"])
+	}
+	if contents["README"] != "nothing to see\n" {
+		t.Errorf("Expected untouched member, got %q", contents["README"])
+	}
+
+	// Nothing survives, and the vault restores the members
+	leaks, err := verifyTree(tmpDir, tmpDir, findings, Policies{}, MatchGlobal, BinaryTruncate, Default())
+	if err != nil || len(leaks) != 0 {
+		t.Errorf("Expected no leaks, got %v (%v)", leaks, err)
+	}
+	restored, missing, err := unmaskTree(tmpDir, masker.VaultEntries(), Default())
+	if err != nil || restored != 2 || len(missing) != 0 {
+		t.Fatalf("Expected 2 restored placeholders, got %d, missing %v (%v)", restored, missing, err)
+	}
+	unmasked, _ := os.ReadFile(testFilePath)
+	if _, unmaskedContents := readZip(t, unmasked); unmaskedContents["config/app.properties"] != "db.user=admin\ndb.password=s3cr3t\n" {
+		t.Errorf("Expected restored properties, got %q", unmaskedContents["config/app.properties"])
+	}
+}
+
+func TestSplitArchivePath(t *testing.T) {
+	tests := []struct {
+		file, archive, member string
+	}{
+		{"src/app.jar!BOOT-INF/application.yml", "src/app.jar", "BOOT-INF/application.yml"},
+		{"a.zip!b.jar!c.txt", "a.zip", "b.jar!c.txt"},
+		{"docs/why!.md", "docs/why!.md", ""},
+		{"plain.txt", "plain.txt", ""},
+	}
+	for _, tt := range tests {
+		archive, member := splitArchivePath(tt.file)
+		if archive != tt.archive || member != tt.member {
+			t.Errorf("splitArchivePath(%q) = %q, %q, expected %q, %q", tt.file, archive, member, tt.archive, tt.member)
+		}
+	}
+}
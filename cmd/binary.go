@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// binaryNote is the text left behind for a masked binary file
+const binaryNote = "This file was %s because it contained secrets found by %s. Original file: %s\n"
+
+// maxSidecars is the number of numbered sidecar names tried before giving up
+const maxSidecars = 100
+
+// BinaryStrategy controls what happens to binary files with findings
+type BinaryStrategy int
+
+const (
+	// BinaryTruncate empties the file and writes a note next to it
+	BinaryTruncate BinaryStrategy = iota
+	// BinaryDelete removes the file and writes a note next to it
+	BinaryDelete
+	// BinaryStub replaces the content of the file with the note
+	BinaryStub
+	// BinaryKeep leaves the file as it is
+	BinaryKeep
+)
+
+// String returns the string representation of the binary strategy
+func (bs BinaryStrategy) String() string {
+	switch bs {
+	case BinaryTruncate:
+		return "truncate"
+	case BinaryDelete:
+		return "delete"
+	case BinaryStub:
+		return "stub"
+	case BinaryKeep:
+		return "keep"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseBinaryStrategy parses a string into a BinaryStrategy
+func ParseBinaryStrategy(strategy string) (BinaryStrategy, error) {
+	switch strings.ToLower(strategy) {
+	case "truncate":
+		return BinaryTruncate, nil
+	case "delete":
+		return BinaryDelete, nil
+	case "stub":
+		return BinaryStub, nil
+	case "keep":
+		return BinaryKeep, nil
+	default:
+		return BinaryTruncate, fmt.Errorf("unknown binary strategy: %s", strategy)
+	}
+}
+
+// strictness orders the strategies by how much of the file they remove, so the
+// strictest strategy wins if the findings of a file disagree
+func (bs BinaryStrategy) strictness() int {
+	switch bs {
+	case BinaryKeep:
+		return 0
+	case BinaryStub:
+		return 1
+	case BinaryTruncate:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// binaryStrategy returns the strictest strategy of the findings in the given file
+func (m *Masker) binaryStrategy(path string, findings []finding) BinaryStrategy {
+	if len(findings) == 0 {
+		return m.binary
+	}
+	strategy := BinaryKeep
+	for _, f := range findings {
+		s := m.binary
+		if p := m.policyFor(path, f); p.Binary != "" {
+			s, _ = ParseBinaryStrategy(p.Binary) // validated when the config is loaded
+		}
+		if s.strictness() > strategy.strictness() {
+			strategy = s
+		}
+	}
+	return strategy
+}
+
+// binaryNote returns the note left behind for a binary file masked with the strategy
+func (m *Masker) binaryNote(path string, strategy BinaryStrategy, findings []finding) []byte {
+	actions := map[BinaryStrategy]string{BinaryTruncate: "emptied", BinaryDelete: "deleted", BinaryStub: "replaced by this note"}
+	return fmt.Appendf(nil, binaryNote, actions[strategy], describeFindings(findings), filepath.ToSlash(relativeTo(m.targetDir, path)))
+}
+
+// describeFindings names the rules and IDs of the findings, e.g. for the note
+// left behind for a binary file
+func describeFindings(findings []finding) string {
+	parts := make([]string, 0, len(findings))
+	for _, f := range findings {
+		parts = append(parts, fmt.Sprintf("rule %s (finding %s)", f.RuleID, f.ID))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// writeSidecar writes the note for a binary file next to it. The name is derived
+// from the full file name, e.g. keystore.jks.masked.txt, and numbered if another
+// file of that name exists. A note with the same content from an earlier run is reused.
+func writeSidecar(path string, note []byte) (string, error) {
+	for i := 1; i <= maxSidecars; i++ {
+		sidecar := path + ".masked.txt"
+		if i > 1 {
+			sidecar = fmt.Sprintf("%s.masked.%d.txt", path, i)
+		}
+
+		f, err := os.OpenFile(sidecar, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			if existing, err := os.ReadFile(sidecar); err == nil && bytes.Equal(existing, note) {
+				return sidecar, nil
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(note)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return sidecar, err
+	}
+	return "", fmt.Errorf("no free name for the note of %s", filepath.Base(path))
+}
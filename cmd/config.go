@@ -1,21 +1,136 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 type Config struct {
-	findingsPath    string
+	findingsPaths   []string
+	outputPath      string
+	findingsFormat  FindingsFormat
 	sourceDir       string
 	targetDir       string
 	logger          *Logger
 	showHelp        bool
 	shutdownTimeout time.Duration
 	placeholderMask string
-	newLineSequence string
+	matchMode       MatchMode
+	binary          BinaryStrategy
+	configPath      string
+	policies        Policies
+	idMode          IDMode
+	idScope         IDScope
+	idKey           []byte
+	idNamespace     uuid.UUID
+	vaultPath       string
+	vaultKey        []byte
+	verify          bool
+	stripOutputs    bool
+	pemMode         PEMMode
+	maskEncoded     bool
+	mode            RunMode
+	commitMapPath   string
+	gitMode         GitMode
+	excludes        []string
+	includes        []string
+	gitignore       bool
+	sync            bool
+	syncStatePath   string
+	inPlace         bool
+	force           bool
+	backupDir       string
+}
+
+// stringList is a flag that can be repeated, collecting one value per occurrence.
+// The default values are replaced by the first explicitly set value.
+type stringList struct {
+	values []string
+	set    bool
+}
+
+// String returns the values as a comma separated list
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(s.values, ",")
+}
+
+// Set appends a value to the list
+func (s *stringList) Set(value string) error {
+	if !s.set {
+		s.values = nil
+		s.set = true
+	}
+	s.values = append(s.values, value)
+	return nil
+}
+
+// expandGlobs expands glob patterns in the given paths, keeping plain paths as they are
+func expandGlobs(paths []string) ([]string, error) {
+	var expanded []string
+	for _, p := range paths {
+		if !strings.ContainsAny(p, "*?[") {
+			expanded = append(expanded, filepath.Clean(p))
+			continue
+		}
+
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", p, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", p)
+		}
+		sort.Strings(matches)
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+// groupedOutputPath derives the path of the grouped findings file from the findings path
+func groupedOutputPath(findingsPath string) string {
+	if strings.Contains(findingsPath, "gitleaks") {
+		return strings.NewReplacer("gitleaks", "gitleaks-grouped").Replace(findingsPath)
+	}
+
+	// Never overwrite the input report
+	ext := filepath.Ext(findingsPath)
+	return strings.TrimSuffix(findingsPath, ext) + ".grouped.json"
+}
+
+// printFlags prints the given flags of the flag set in the given order
+func printFlags(fs *flag.FlagSet, orderedFlags []string) {
+	for _, name := range orderedFlags {
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+
+		defaultValue := f.DefValue
+		if f.Name == "mask" {
+			// Special handling for mask to escape % characters
+			defaultValue = fmt.Sprintf("%q", defaultValue)
+		}
+		fmt.Printf("  --%-18s %s [default: %v]\n", f.Name, f.Usage, defaultValue)
+	}
+}
+
+// printConfigurationHelp explains how flags can be set besides the command line
+func printConfigurationHelp() {
+	fmt.Println("\nConfiguration:")
+	fmt.Println("  Every flag can also be set through an environment variable, e.g. CREDENTIAL_MASKER_LOG_LEVEL,")
+	fmt.Println("  or, except for secrets, a key of the same name in a YAML or TOML config file. Flags take precedence over the")
+	fmt.Println("  environment, which takes precedence over the config file.")
 }
 
 // setupUsage creates a custom usage function that prints help information
@@ -24,29 +139,85 @@ func setupUsage() {
 		fmt.Println("Credential Masker - A tool to mask credentials in source code")
 		fmt.Println("\nUsage:")
 		fmt.Println("  credential-masker [flags]")
+		fmt.Println("  credential-masker unmask [flags]")
+		fmt.Println("  credential-masker verify [flags]")
 		fmt.Println("\nFlags:")
 
-		// Define the custom order of flags
-		orderedFlags := []string{"source", "target", "findings", "mask", "newline", "shutdown-timeout", "log-level", "help"}
-
 		// Print flags in the specified order
-		for _, name := range orderedFlags {
-			f := flag.Lookup(name)
-			if f == nil {
-				continue
-			}
+		printFlags(flag.CommandLine, []string{"config", "mode", "source", "target", "in-place", "force", "backup-dir", "findings", "findings-format", "output", "commit-map", "git", "exclude", "include", "gitignore", "sync", "sync-state", "mask", "rule-mask", "id-mode", "id-scope", "id-key", "id-key-file", "id-namespace", "match-mode", "binary", "pem-mode", "mask-encoded", "vault", "vault-passphrase", "vault-key-file", "verify", "strip-outputs", "shutdown-timeout", "log-level", "help"})
+		printConfigurationHelp()
 
-			defaultValue := f.DefValue
-			if f.Name == "mask" {
-				// Special handling for mask to escape % characters
-				defaultValue = fmt.Sprintf("%q", defaultValue)
+		fmt.Println("\nExample:")
+		fmt.Println("  credential-masker --source ./myproject --target ./masked-project --findings ./gitleaks.json")
+	}
+}
+
+// isInside reports whether path is dir or inside of it
+func isInside(dir, path string) bool {
+	absDir, errDir := filepath.Abs(dir)
+	absPath, errPath := filepath.Abs(path)
+	if errDir != nil || errPath != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// hashesSecrets reports whether any placeholder, global or of a policy, fills in
+// the Hash field
+func (c *Config) hashesSecrets() bool {
+	if usesHash(c.placeholderMask) {
+		return true
+	}
+	for _, policies := range []map[string]Policy{c.policies.Rules, c.policies.Paths} {
+		for _, p := range policies {
+			if usesHash(p.Placeholder) {
+				return true
 			}
-			fmt.Printf("  --%-18s %s [default: %v]\n", f.Name, f.Usage, defaultValue)
 		}
+	}
+	return false
+}
 
-		fmt.Println("\nExample:")
-		fmt.Println("  credential-masker --source ./myproject --target ./masked-project --findings ./gitleaks.json")
+// buildPolicies merges the policies of the config file with the --rule-mask flags
+func buildPolicies(fc *fileConfig, ruleMasks []string) (Policies, error) {
+	policies := Policies{Rules: map[string]Policy{}}
+	if fc != nil {
+		policies.Paths = fc.Paths
+		for pattern, p := range fc.Rules {
+			policies.Rules[pattern] = p
+		}
+	}
+	for _, ruleMask := range ruleMasks {
+		pattern, template, ok := strings.Cut(ruleMask, "=")
+		if !ok || pattern == "" {
+			return Policies{}, fmt.Errorf("invalid flag --rule-mask: expected <rule glob>=<template>, got %q", ruleMask)
+		}
+		p := policies.Rules[pattern]
+		p.Placeholder = template
+		policies.Rules[pattern] = p
+	}
+	if err := policies.validate(); err != nil {
+		return Policies{}, fmt.Errorf("invalid policies: %v", err)
 	}
+	return policies, nil
+}
+
+// loadConfigSources fills the unset flags of the flag set from the environment and
+// the config file. It returns the config file and its path, if one was used.
+func loadConfigSources(fs *flag.FlagSet, configPath string) (*fileConfig, string, error) {
+	var fc *fileConfig
+	cleanConfigPath := resolveConfigPath(fs, configPath)
+	if cleanConfigPath != "" {
+		var err error
+		if fc, err = loadConfigFile(cleanConfigPath); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := applyConfigSources(fs, fc); err != nil {
+		return nil, "", err
+	}
+	return fc, cleanConfigPath, nil
 }
 
 func parseAndValidateFlags() (*Config, error) {
@@ -54,12 +225,45 @@ func parseAndValidateFlags() (*Config, error) {
 	setupUsage()
 
 	// Flag definitions here serve as the single source of truth for default values
-	findingsPath := flag.String("findings", "reports/arcon_formulare.gitleaks.json", "Path to Gitleaks findings JSON file")
-	sourceDir := flag.String("source", "external/source/arcon_formulare", "Path to source repository")
-	targetDir := flag.String("target", "external/target/arcon_formulare", "Path to target repository for masked files")
+	configPath := flag.String("config", "", "Path to a YAML or TOML config file, credential-masker.{yaml,yml,toml} is used if present")
+	findingsPaths := &stringList{}
+	flag.Var(findingsPaths, "findings", "Path or glob of a findings file, can be repeated to merge reports of several scanners")
+	findingsFormatStr := flag.String("findings-format", "auto", "Format of the findings file (auto, gitleaks, sarif, trufflehog, detect-secrets)")
+	outputPath := flag.String("output", "", "Path of the grouped findings file, derived from the first findings file if empty")
+	sourceDir := flag.String("source", "", "Path to source repository")
+	targetDir := flag.String("target", "", "Path to target repository for masked files")
+	modeStr := flag.String("mode", "tree", "What is masked (tree: a copy of the source directory, history: every commit of the source repository, written to a new repository)")
+	commitMapPath := flag.String("commit-map", "", "Path of the map from original to rewritten commit IDs in history mode (default: commit-map in the .git directory of the target)")
+	gitModeStr := flag.String("git", "drop", "What happens to the .git directory when the source is copied (drop, keep, fresh: a new repository with a single commit of the masked tree)")
+	excludes := &stringList{}
+	flag.Var(excludes, "exclude", "Glob of files not to copy to the target, in the syntax of .gitignore, can be repeated")
+	includes := &stringList{}
+	flag.Var(includes, "include", "Glob of files to copy even if an ignore file or --exclude excludes them, can be repeated")
+	gitignore := flag.Bool("gitignore", true, "Leave the files ignored by .gitignore files out of the copy, .maskerignore files are always honored")
+	inPlace := flag.Bool("in-place", false, "Mask the source directory itself instead of a copy, --target may be omitted")
+	force := flag.Bool("force", false, "Mask in place even if the source has uncommitted changes")
+	backupDir := flag.String("backup-dir", "", "Directory to back up the files with findings to before masking in place")
+	sync := flag.Bool("sync", false, "If the target exists, copy only the files that changed in the source, remove those gone from it and mask only what changed")
+	syncStatePath := flag.String("sync-state", "", "Path of the state file of --sync, recording what was masked last time (default: <target>.sync-state.json)")
 	shutdownTimeout := flag.Int("shutdown-timeout", 15, "Timeout in seconds for graceful shutdown")
-	placeholderMask := flag.String("mask", "***MASKED[\"%s__%s__%s\"]***", "Placeholder text for masked credentials. To be filled with 1. file prefix 2. finding ID 3. finding UUID")
-	newLineSequence := flag.String("newline", "\\r\\n", "Newline sequence to use when writing files")
+	placeholderMask := flag.String("mask", "***MASKED[\"%s__%s__%s\"]***", "Placeholder text for masked credentials. Either a fmt template filled with 1. file prefix 2. finding ID 3. finding UUID 4. sequence number of the secret within its rule, or a text/template with named fields such as {{.RuleID}} and {{.Hash}}")
+	ruleMasks := &stringList{}
+	flag.Var(ruleMasks, "rule-mask", "Placeholder for findings of matching rules as <rule glob>=<template>, can be repeated")
+	idModeStr := flag.String("id-mode", "random", "How placeholder IDs are assigned (random, hmac, uuidv5)")
+	idScopeStr := flag.String("id-scope", "location", "Which findings share a deterministic ID (location, secret)")
+	idKey := flag.String("id-key", "", "Key for HMAC IDs and {{.Hash}} placeholders, prefer --id-key-file or the environment")
+	idKeyFile := flag.String("id-key-file", "", "Path to a file holding the key for HMAC IDs and {{.Hash}} placeholders")
+	idNamespaceStr := flag.String("id-namespace", defaultIDNamespace.String(), "UUID namespace for UUIDv5 IDs")
+	matchModeStr := flag.String("match-mode", "global", "How secrets are located in files (global, position)")
+	binaryStr := flag.String("binary", "truncate", "What happens to binary files with findings (truncate, delete, stub, keep)")
+	pemModeStr := flag.String("pem-mode", "full", "How PEM blocks such as private keys are masked (full, body to keep the BEGIN and END lines)")
+	maskEncoded := flag.Bool("mask-encoded", false, "Also mask base64, hex, URL and JSON encoded copies of each secret, reported as derived findings")
+	newLineSequence := flag.String("newline", "", "Deprecated and ignored, the line endings of every file are preserved")
+	vaultPath := flag.String("vault", "", "Path of an encrypted vault to write, mapping placeholders to secrets for the unmask command")
+	vaultPassphrase := flag.String("vault-passphrase", "", "Passphrase for the vault, prefer --vault-key-file or the environment")
+	vaultKeyFile := flag.String("vault-key-file", "", "Path to a key file for the vault")
+	verify := flag.Bool("verify", true, "Verify that no secret survived in the target directory, failing the run otherwise")
+	stripOutputs := flag.Bool("strip-outputs", false, "Remove all outputs from Jupyter notebooks with findings")
 	logLevelStr := flag.String("log-level", "INFO", "Log level (DEBUG, INFO, SUCCESS, WARNING, ERROR, FATAL)")
 	showHelp := flag.Bool("help", false, "Display help information")
 
@@ -70,15 +274,39 @@ func parseAndValidateFlags() (*Config, error) {
 		return &Config{showHelp: true}, nil
 	}
 
+	// Fill unset flags from the environment and the config file
+	fc, cleanConfigPath, err := loadConfigSources(flag.CommandLine, *configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := buildPolicies(fc, ruleMasks.values)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePlaceholder(*placeholderMask); err != nil {
+		return nil, fmt.Errorf("invalid flag --mask: %v", err)
+	}
+
 	if *sourceDir == "" {
 		return nil, fmt.Errorf("missing required flag: --source")
 	}
+	if *inPlace {
+		if *targetDir != "" && filepath.Clean(*targetDir) != filepath.Clean(*sourceDir) {
+			return nil, fmt.Errorf("invalid flag --target: must be empty or equal to --source with --in-place")
+		}
+		*targetDir = *sourceDir
+	}
 	if *targetDir == "" {
 		return nil, fmt.Errorf("missing required flag: --target")
 	}
-	if *findingsPath == "" {
+	if len(findingsPaths.values) == 0 {
 		return nil, fmt.Errorf("missing required flag: --findings")
 	}
+	cleanFindingsPaths, err := expandGlobs(findingsPaths.values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flag --findings: %v", err)
+	}
 
 	// Parse log level
 	logLevel, err := ParseLogLevel(*logLevelStr)
@@ -86,23 +314,331 @@ func parseAndValidateFlags() (*Config, error) {
 		return nil, fmt.Errorf("invalid log level: %v", err)
 	}
 
+	// Parse findings format
+	findingsFormat, err := ParseFindingsFormat(*findingsFormatStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid findings format: %v", err)
+	}
+
+	// Parse run mode
+	mode, err := ParseRunMode(*modeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mode: %v", err)
+	}
+
+	// Parse git mode
+	gitMode, err := ParseGitMode(*gitModeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git mode: %v", err)
+	}
+
+	if *sync && mode != ModeTree {
+		return nil, fmt.Errorf("invalid flag --sync: only supported with --mode tree")
+	}
+	if *inPlace && (mode != ModeTree || *sync) {
+		return nil, fmt.Errorf("invalid flag --in-place: not supported with --mode history or --sync")
+	}
+
+	// Parse match mode
+	matchMode, err := ParseMatchMode(*matchModeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid match mode: %v", err)
+	}
+
+	// Parse binary strategy
+	binary, err := ParseBinaryStrategy(*binaryStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid binary strategy: %v", err)
+	}
+
+	// Parse PEM mode
+	pemMode, err := ParsePEMMode(*pemModeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PEM mode: %v", err)
+	}
+
+	// Parse placeholder ID settings
+	idMode, err := ParseIDMode(*idModeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID mode: %v", err)
+	}
+	idScope, err := ParseIDScope(*idScopeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID scope: %v", err)
+	}
+	idNamespace, err := uuid.Parse(*idNamespaceStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID namespace: %v", err)
+	}
+	key := []byte(*idKey)
+	if *idKeyFile != "" {
+		if key, err = os.ReadFile(*idKeyFile); err != nil {
+			return nil, fmt.Errorf("error reading ID key file: %v", err)
+		}
+		key = bytes.TrimSpace(key)
+	}
+	if idMode == IDHMAC && len(key) == 0 {
+		return nil, fmt.Errorf("missing required flag for --id-mode hmac: --id-key or --id-key-file")
+	}
+
+	// Read the vault key, the vault must never end up in the shared tree
+	var vaultKey []byte
+	cleanVaultPath := ""
+	if *vaultPath != "" {
+		cleanVaultPath = filepath.Clean(*vaultPath)
+		if isInside(filepath.Clean(*targetDir), cleanVaultPath) {
+			return nil, fmt.Errorf("invalid flag --vault: %s is inside the target directory", cleanVaultPath)
+		}
+		if vaultKey, err = vaultKeyMaterial(*vaultPassphrase, *vaultKeyFile); err != nil {
+			return nil, fmt.Errorf("invalid flag --vault: %v", err)
+		}
+	}
+
 	// Create logger with Configured log level
 	logger := Default()
 	logger.SetMinLevel(logLevel)
+	if *newLineSequence != "" {
+		logger.Warning("--newline is deprecated and ignored, the line endings of every file are preserved")
+	}
 
 	// Clean all paths
 	cleanSourceDir := filepath.Clean(*sourceDir)
 	cleanTargetDir := filepath.Clean(*targetDir)
-	cleanFindingsPath := filepath.Clean(*findingsPath)
+	cleanOutputPath := groupedOutputPath(cleanFindingsPaths[0])
+	if *outputPath != "" {
+		cleanOutputPath = filepath.Clean(*outputPath)
+	}
+	cleanCommitMapPath := filepath.Join(cleanTargetDir, ".git", "commit-map")
+	if *commitMapPath != "" {
+		cleanCommitMapPath = filepath.Clean(*commitMapPath)
+	}
+
+	// Backups hold the secrets, so they must not end up in the masked tree
+	cleanBackupDir := ""
+	if *backupDir != "" {
+		cleanBackupDir = filepath.Clean(*backupDir)
+		if !*inPlace {
+			return nil, fmt.Errorf("invalid flag --backup-dir: only supported with --in-place")
+		}
+		if isInside(cleanTargetDir, cleanBackupDir) {
+			return nil, fmt.Errorf("invalid flag --backup-dir: %s is inside the masked directory", cleanBackupDir)
+		}
+	}
+
+	// The state file holds digests of the secrets, so it is kept out of the target like the vault
+	cleanSyncStatePath := cleanTargetDir + ".sync-state.json"
+	if *syncStatePath != "" {
+		cleanSyncStatePath = filepath.Clean(*syncStatePath)
+	}
+	if *sync && isInside(cleanTargetDir, cleanSyncStatePath) {
+		return nil, fmt.Errorf("invalid flag --sync-state: %s is inside the target directory", cleanSyncStatePath)
+	}
 
 	return &Config{
-		findingsPath:    cleanFindingsPath,
+		findingsPaths:   cleanFindingsPaths,
+		outputPath:      cleanOutputPath,
+		findingsFormat:  findingsFormat,
 		sourceDir:       cleanSourceDir,
 		targetDir:       cleanTargetDir,
 		logger:          logger,
 		showHelp:        *showHelp,
 		shutdownTimeout: time.Duration(*shutdownTimeout) * time.Second,
 		placeholderMask: *placeholderMask,
-		newLineSequence: *newLineSequence,
+		matchMode:       matchMode,
+		binary:          binary,
+		configPath:      cleanConfigPath,
+		policies:        policies,
+		idMode:          idMode,
+		idScope:         idScope,
+		idKey:           key,
+		idNamespace:     idNamespace,
+		vaultPath:       cleanVaultPath,
+		vaultKey:        vaultKey,
+		verify:          *verify,
+		stripOutputs:    *stripOutputs,
+		pemMode:         pemMode,
+		maskEncoded:     *maskEncoded,
+		mode:            mode,
+		commitMapPath:   cleanCommitMapPath,
+		gitMode:         gitMode,
+		excludes:        excludes.values,
+		includes:        includes.values,
+		gitignore:       *gitignore,
+		sync:            *sync,
+		syncStatePath:   cleanSyncStatePath,
+		inPlace:         *inPlace,
+		force:           *force,
+		backupDir:       cleanBackupDir,
+	}, nil
+}
+
+// UnmaskConfig holds the settings of the unmask command
+type UnmaskConfig struct {
+	targetDir string
+	vaultPath string
+	vaultKey  []byte
+	logger    *Logger
+	showHelp  bool
+}
+
+// parseUnmaskFlags parses the flags of the unmask command
+func parseUnmaskFlags(args []string) (*UnmaskConfig, error) {
+	fs := flag.NewFlagSet("unmask", flag.ContinueOnError)
+	configPath := fs.String("config", "", "Path to a YAML or TOML config file, credential-masker.{yaml,yml,toml} is used if present")
+	targetDir := fs.String("target", "", "Path to the masked tree to restore")
+	vaultPath := fs.String("vault", "", "Path of the vault written by the masking run")
+	vaultPassphrase := fs.String("vault-passphrase", "", "Passphrase for the vault, prefer --vault-key-file or the environment")
+	vaultKeyFile := fs.String("vault-key-file", "", "Path to a key file for the vault")
+	logLevelStr := fs.String("log-level", "INFO", "Log level (DEBUG, INFO, SUCCESS, WARNING, ERROR, FATAL)")
+	showHelp := fs.Bool("help", false, "Display help information")
+
+	fs.Usage = func() {
+		fmt.Println("Credential Masker - Restore the secrets of a masked tree from its vault")
+		fmt.Println("\nUsage:")
+		fmt.Println("  credential-masker unmask [flags]")
+		fmt.Println("\nFlags:")
+		printFlags(fs, []string{"config", "target", "vault", "vault-passphrase", "vault-key-file", "log-level", "help"})
+		printConfigurationHelp()
+
+		fmt.Println("\nExample:")
+		fmt.Println("  credential-masker unmask --target ./masked-project --vault ./masked-project.vault --vault-key-file ./vault.key")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *showHelp {
+		fs.Usage()
+		return &UnmaskConfig{showHelp: true}, nil
+	}
+
+	if _, _, err := loadConfigSources(fs, *configPath); err != nil {
+		return nil, err
+	}
+
+	if *targetDir == "" {
+		return nil, fmt.Errorf("missing required flag: --target")
+	}
+	if *vaultPath == "" {
+		return nil, fmt.Errorf("missing required flag: --vault")
+	}
+	vaultKey, err := vaultKeyMaterial(*vaultPassphrase, *vaultKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flag --vault: %v", err)
+	}
+
+	logLevel, err := ParseLogLevel(*logLevelStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level: %v", err)
+	}
+	logger := Default()
+	logger.SetMinLevel(logLevel)
+
+	return &UnmaskConfig{
+		targetDir: filepath.Clean(*targetDir),
+		vaultPath: filepath.Clean(*vaultPath),
+		vaultKey:  vaultKey,
+		logger:    logger,
+	}, nil
+}
+
+// VerifyConfig holds the settings of the verify command
+type VerifyConfig struct {
+	findingsPaths  []string
+	findingsFormat FindingsFormat
+	sourceDir      string
+	targetDir      string
+	policies       Policies
+	matchMode      MatchMode
+	binary         BinaryStrategy
+	logger         *Logger
+	showHelp       bool
+}
+
+// parseVerifyFlags parses the flags of the verify command
+func parseVerifyFlags(args []string) (*VerifyConfig, error) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	configPath := fs.String("config", "", "Path to a YAML or TOML config file, credential-masker.{yaml,yml,toml} is used if present")
+	findingsPaths := &stringList{}
+	fs.Var(findingsPaths, "findings", "Path or glob of a findings file, can be repeated to merge reports of several scanners")
+	findingsFormatStr := fs.String("findings-format", "auto", "Format of the findings file (auto, gitleaks, sarif, trufflehog, detect-secrets)")
+	sourceDir := fs.String("source", "", "Path to source repository the findings were reported for")
+	targetDir := fs.String("target", "", "Path to the masked tree to verify")
+	matchModeStr := fs.String("match-mode", "global", "Match mode of the masking run, in position mode secrets are only searched on the reported lines")
+	binaryStr := fs.String("binary", "truncate", "Binary strategy of the masking run, binary files kept by it may hold secrets")
+	logLevelStr := fs.String("log-level", "INFO", "Log level (DEBUG, INFO, SUCCESS, WARNING, ERROR, FATAL)")
+	showHelp := fs.Bool("help", false, "Display help information")
+
+	fs.Usage = func() {
+		fmt.Println("Credential Masker - Verify that no secret of the findings survived in a masked tree")
+		fmt.Println("\nUsage:")
+		fmt.Println("  credential-masker verify [flags]")
+		fmt.Println("\nFlags:")
+		printFlags(fs, []string{"config", "source", "target", "findings", "findings-format", "match-mode", "binary", "log-level", "help"})
+		printConfigurationHelp()
+
+		fmt.Println("\nExample:")
+		fmt.Println("  credential-masker verify --source ./myproject --target ./masked-project --findings ./gitleaks.json")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *showHelp {
+		fs.Usage()
+		return &VerifyConfig{showHelp: true}, nil
+	}
+
+	fc, _, err := loadConfigSources(fs, *configPath)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := buildPolicies(fc, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if *sourceDir == "" {
+		return nil, fmt.Errorf("missing required flag: --source")
+	}
+	if *targetDir == "" {
+		return nil, fmt.Errorf("missing required flag: --target")
+	}
+	if len(findingsPaths.values) == 0 {
+		return nil, fmt.Errorf("missing required flag: --findings")
+	}
+	cleanFindingsPaths, err := expandGlobs(findingsPaths.values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flag --findings: %v", err)
+	}
+	findingsFormat, err := ParseFindingsFormat(*findingsFormatStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid findings format: %v", err)
+	}
+	matchMode, err := ParseMatchMode(*matchModeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid match mode: %v", err)
+	}
+	binary, err := ParseBinaryStrategy(*binaryStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid binary strategy: %v", err)
+	}
+
+	logLevel, err := ParseLogLevel(*logLevelStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level: %v", err)
+	}
+	logger := Default()
+	logger.SetMinLevel(logLevel)
+
+	return &VerifyConfig{
+		findingsPaths:  cleanFindingsPaths,
+		findingsFormat: findingsFormat,
+		sourceDir:      filepath.Clean(*sourceDir),
+		targetDir:      filepath.Clean(*targetDir),
+		policies:       policies,
+		matchMode:      matchMode,
+		binary:         binary,
+		logger:         logger,
 	}, nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyConfigSources_Precedence(t *testing.T) {
+	fc, err := loadConfigFile(filepath.Join("..", "testdata", "credential-masker.yaml"))
+	if err != nil {
+		t.Fatalf("loadConfigFile failed: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	findings := &stringList{}
+	fs.Var(findings, "findings", "")
+	source := fs.String("source", "", "")
+	target := fs.String("target", "", "")
+	logLevel := fs.String("log-level", "INFO", "")
+	matchMode := fs.String("match-mode", "global", "")
+	mask := fs.String("mask", "default", "")
+
+	// Flags win over the environment, which wins over the config file
+	if err := fs.Parse([]string{"--source", "cli"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	t.Setenv("CREDENTIAL_MASKER_SOURCE", "env")
+	t.Setenv("CREDENTIAL_MASKER_LOG_LEVEL", "DEBUG")
+
+	if err := applyConfigSources(fs, fc); err != nil {
+		t.Fatalf("applyConfigSources failed: %v", err)
+	}
+
+	if *source != "cli" {
+		t.Errorf("Expected source from flag, but got %q", *source)
+	}
+	if *logLevel != "DEBUG" {
+		t.Errorf("Expected log level from environment, but got %q", *logLevel)
+	}
+	if *matchMode != "position" {
+		t.Errorf("Expected match mode from config file, but got %q", *matchMode)
+	}
+	if *mask != "default" {
+		t.Errorf("Expected default mask, but got %q", *mask)
+	}
+
+	// Paths in the config file are relative to the file
+	if expected := filepath.Join("..", "target"); *target != expected {
+		t.Errorf("Expected target %q, but got %q", expected, *target)
+	}
+	if len(findings.values) != 2 || findings.values[0] != filepath.Join("..", "testdata", "reports", "repo.gitleaks.json") {
+		t.Errorf("Unexpected findings paths: %v", findings.values)
+	}
+}
+
+func TestFileConfig_EveryFlag(t *testing.T) {
+	// Register the flags of the main command without running it
+	defer func(args []string, commandLine *flag.FlagSet) { os.Args, flag.CommandLine = args, commandLine }(os.Args, flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet("credential-masker", flag.ContinueOnError)
+	os.Args = []string{"credential-masker", "--help"}
+	if _, err := parseAndValidateFlags(); err != nil {
+		t.Fatalf("parseAndValidateFlags failed: %v", err)
+	}
+
+	// Flags that deliberately have no key in the config file
+	noKey := map[string]bool{"config": true, "help": true, "rule-mask": true, "id-key": true, "vault-passphrase": true}
+
+	var doc strings.Builder
+	var names []string
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if noKey[f.Name] {
+			return
+		}
+		names = append(names, f.Name)
+		value := `"value"`
+		if _, isList := f.Value.(*stringList); isList {
+			value = `["value"]`
+		} else if getter, ok := f.Value.(flag.Getter); ok {
+			switch getter.Get().(type) {
+			case bool:
+				value = "true"
+			case int:
+				value = "1"
+			}
+		}
+		fmt.Fprintf(&doc, "%s: %s\n", f.Name, value)
+	})
+
+	path := filepath.Join(t.TempDir(), "credential-masker.yaml")
+	if err := os.WriteFile(path, []byte(doc.String()), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	fc, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Every flag should have a key in the config file: %v", err)
+	}
+	values := fc.flagValues()
+	for _, name := range names {
+		if len(values[name]) == 0 {
+			t.Errorf("Key %q of the config file does not set flag --%s", name, name)
+		}
+	}
+	if expected := filepath.Join(filepath.Dir(path), "value"); fc.IDKeyFile != expected {
+		t.Errorf("Expected id-key-file %q relative to the config file, got %q", expected, fc.IDKeyFile)
+	}
+}
+
+func TestPolicies_For(t *testing.T) {
+	fc, err := loadConfigFile(filepath.Join("..", "testdata", "credential-masker.yaml"))
+	if err != nil {
+		t.Fatalf("loadConfigFile failed: %v", err)
+	}
+	policies := Policies{Rules: fc.Rules, Paths: fc.Paths}
+	if err := policies.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+
+	tests := []struct {
+		ruleID    string
+		path      string
+		skip      bool
+		matchMode string
+	}{
+		{ruleID: "aws-access-key", path: "src/main.go"},
+		{ruleID: "generic-api-key", path: "src/main.go", matchMode: "global"},
+		{ruleID: "test-rule", path: "src/main.go", skip: true},
+		{ruleID: "aws-access-key", path: "docs/README.md", skip: true},
+		{ruleID: "aws-access-key", path: "docs/examples/app/config.yaml", matchMode: "global"},
+	}
+
+	for _, tt := range tests {
+		p := policies.For(tt.ruleID, tt.path)
+		if p.Skip != tt.skip || p.MatchMode != tt.matchMode {
+			t.Errorf("For(%s, %s) = %+v, expected skip=%v match-mode=%q", tt.ruleID, tt.path, p, tt.skip, tt.matchMode)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables that set flags,
+// e.g. CREDENTIAL_MASKER_LOG_LEVEL for --log-level
+const envPrefix = "CREDENTIAL_MASKER_"
+
+// defaultConfigFiles are looked up in the working directory if no --config is given
+var defaultConfigFiles = []string{"credential-masker.yaml", "credential-masker.yml", "credential-masker.toml"}
+
+// fileConfig is the structure of the YAML or TOML configuration file. Every key
+// mirrors the flag of the same name, except for the secrets --id-key and
+// --vault-passphrase, which do not belong in a file, and --rule-mask, which is
+// covered by the rule policies.
+type fileConfig struct {
+	Findings        []string          `yaml:"findings" toml:"findings"`
+	FindingsFormat  string            `yaml:"findings-format" toml:"findings-format"`
+	Output          string            `yaml:"output" toml:"output"`
+	Source          string            `yaml:"source" toml:"source"`
+	Target          string            `yaml:"target" toml:"target"`
+	Mode            string            `yaml:"mode" toml:"mode"`
+	CommitMap       string            `yaml:"commit-map" toml:"commit-map"`
+	Git             string            `yaml:"git" toml:"git"`
+	Exclude         []string          `yaml:"exclude" toml:"exclude"`
+	Include         []string          `yaml:"include" toml:"include"`
+	Gitignore       *bool             `yaml:"gitignore" toml:"gitignore"`
+	InPlace         *bool             `yaml:"in-place" toml:"in-place"`
+	Force           *bool             `yaml:"force" toml:"force"`
+	BackupDir       string            `yaml:"backup-dir" toml:"backup-dir"`
+	Sync            *bool             `yaml:"sync" toml:"sync"`
+	SyncState       string            `yaml:"sync-state" toml:"sync-state"`
+	Mask            string            `yaml:"mask" toml:"mask"`
+	IDMode          string            `yaml:"id-mode" toml:"id-mode"`
+	IDScope         string            `yaml:"id-scope" toml:"id-scope"`
+	IDKeyFile       string            `yaml:"id-key-file" toml:"id-key-file"`
+	IDNamespace     string            `yaml:"id-namespace" toml:"id-namespace"`
+	MatchMode       string            `yaml:"match-mode" toml:"match-mode"`
+	Newline         string            `yaml:"newline" toml:"newline"`
+	Binary          string            `yaml:"binary" toml:"binary"`
+	PEMMode         string            `yaml:"pem-mode" toml:"pem-mode"`
+	MaskEncoded     *bool             `yaml:"mask-encoded" toml:"mask-encoded"`
+	ShutdownTimeout *int              `yaml:"shutdown-timeout" toml:"shutdown-timeout"`
+	LogLevel        string            `yaml:"log-level" toml:"log-level"`
+	Vault           string            `yaml:"vault" toml:"vault"`
+	VaultKeyFile    string            `yaml:"vault-key-file" toml:"vault-key-file"`
+	Verify          *bool             `yaml:"verify" toml:"verify"`
+	StripOutputs    *bool             `yaml:"strip-outputs" toml:"strip-outputs"`
+	Rules           map[string]Policy `yaml:"rules" toml:"rules"`
+	Paths           map[string]Policy `yaml:"paths" toml:"paths"`
+}
+
+// loadConfigFile reads a YAML or TOML configuration file, chosen by its extension
+func loadConfigFile(path string) (*fileConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	var fc fileConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(raw), &fc)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("error parsing config file %s: unknown key %q", path, undecoded[0].String())
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file extension: %s", path)
+	}
+
+	// Relative paths in the file are relative to the file itself, so a config
+	// checked into a repository works from any working directory
+	base := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(base, p)
+	}
+	for i, p := range fc.Findings {
+		fc.Findings[i] = resolve(p)
+	}
+	fc.Output = resolve(fc.Output)
+	fc.Source = resolve(fc.Source)
+	fc.Target = resolve(fc.Target)
+	fc.Vault = resolve(fc.Vault)
+	fc.VaultKeyFile = resolve(fc.VaultKeyFile)
+	fc.IDKeyFile = resolve(fc.IDKeyFile)
+	fc.SyncState = resolve(fc.SyncState)
+	fc.BackupDir = resolve(fc.BackupDir)
+
+	return &fc, nil
+}
+
+// flagValues returns the values set in the file, keyed by flag name
+func (fc *fileConfig) flagValues() map[string][]string {
+	values := make(map[string][]string)
+	set := func(name, value string) {
+		if value != "" {
+			values[name] = []string{value}
+		}
+	}
+
+	if len(fc.Findings) > 0 {
+		values["findings"] = fc.Findings
+	}
+	set("findings-format", fc.FindingsFormat)
+	set("output", fc.Output)
+	set("source", fc.Source)
+	set("target", fc.Target)
+	set("mode", fc.Mode)
+	set("commit-map", fc.CommitMap)
+	set("git", fc.Git)
+	if len(fc.Exclude) > 0 {
+		values["exclude"] = fc.Exclude
+	}
+	if len(fc.Include) > 0 {
+		values["include"] = fc.Include
+	}
+	if fc.Gitignore != nil {
+		set("gitignore", strconv.FormatBool(*fc.Gitignore))
+	}
+	if fc.InPlace != nil {
+		set("in-place", strconv.FormatBool(*fc.InPlace))
+	}
+	if fc.Force != nil {
+		set("force", strconv.FormatBool(*fc.Force))
+	}
+	set("backup-dir", fc.BackupDir)
+	if fc.Sync != nil {
+		set("sync", strconv.FormatBool(*fc.Sync))
+	}
+	set("sync-state", fc.SyncState)
+	set("mask", fc.Mask)
+	set("id-mode", fc.IDMode)
+	set("id-scope", fc.IDScope)
+	set("id-key-file", fc.IDKeyFile)
+	set("id-namespace", fc.IDNamespace)
+	set("match-mode", fc.MatchMode)
+	set("newline", fc.Newline)
+	set("binary", fc.Binary)
+	set("pem-mode", fc.PEMMode)
+	if fc.MaskEncoded != nil {
+		set("mask-encoded", strconv.FormatBool(*fc.MaskEncoded))
+	}
+	if fc.ShutdownTimeout != nil {
+		set("shutdown-timeout", strconv.Itoa(*fc.ShutdownTimeout))
+	}
+	set("log-level", fc.LogLevel)
+	set("vault", fc.Vault)
+	set("vault-key-file", fc.VaultKeyFile)
+	if fc.Verify != nil {
+		set("verify", strconv.FormatBool(*fc.Verify))
+	}
+	if fc.StripOutputs != nil {
+		set("strip-outputs", strconv.FormatBool(*fc.StripOutputs))
+	}
+	return values
+}
+
+// resolveConfigPath returns the configuration file to use, if any: the --config flag,
+// then the environment, then a default file in the working directory
+func resolveConfigPath(fs *flag.FlagSet, configPath string) string {
+	if isFlagSet(fs, "config") {
+		return configPath
+	}
+	if env, ok := os.LookupEnv(envName("config")); ok {
+		return env
+	}
+	for _, name := range defaultConfigFiles {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// applyConfigSources fills every flag that was not set on the command line, first
+// from the environment and then from the configuration file, so the precedence is
+// flags > environment > config file > defaults
+func applyConfigSources(fs *flag.FlagSet, fc *fileConfig) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var fileValues map[string][]string
+	if fc != nil {
+		fileValues = fc.flagValues()
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" || f.Name == "help" {
+			return
+		}
+
+		var values []string
+		if env, ok := os.LookupEnv(envName(f.Name)); ok {
+			values = strings.Split(env, ",")
+			if _, isList := f.Value.(*stringList); !isList {
+				values = []string{env}
+			}
+		} else if v, ok := fileValues[f.Name]; ok {
+			values = v
+		}
+
+		for _, v := range values {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value %q for --%s: %v", v, f.Name, setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// isFlagSet reports whether the flag was set on the command line
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	found := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// envName returns the environment variable for a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
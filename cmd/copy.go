@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	cp "github.com/otiai10/copy"
+)
+
+// GitMode controls what happens to the .git directory of the source when it is copied
+type GitMode int
+
+const (
+	// GitDrop leaves the .git directory out of the copy, since its history holds
+	// every secret that was ever committed
+	GitDrop GitMode = iota
+	// GitKeep copies the .git directory as it is
+	GitKeep
+	// GitFresh leaves the .git directory out and creates a new repository holding
+	// a single commit of the masked tree
+	GitFresh
+)
+
+// String returns the string representation of the git mode
+func (gm GitMode) String() string {
+	switch gm {
+	case GitDrop:
+		return "drop"
+	case GitKeep:
+		return "keep"
+	case GitFresh:
+		return "fresh"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseGitMode parses a string into a GitMode
+func ParseGitMode(mode string) (GitMode, error) {
+	switch strings.ToLower(mode) {
+	case "drop":
+		return GitDrop, nil
+	case "keep":
+		return GitKeep, nil
+	case "fresh":
+		return GitFresh, nil
+	default:
+		return GitDrop, fmt.Errorf("unknown git mode: %s", mode)
+	}
+}
+
+// maskerIgnoreFile lists files that are not copied, in the syntax of .gitignore
+const maskerIgnoreFile = ".maskerignore"
+
+// ignoreRule is a pattern of an ignore file or an --exclude or --include flag
+type ignoreRule struct {
+	base     string // Directory the pattern is relative to, "" for the root
+	pattern  string
+	negate   bool // The pattern includes matching paths again
+	dirOnly  bool // The pattern only matches directories
+	anchored bool // The pattern is matched against the path below base rather than the name
+}
+
+// parseIgnoreRule parses a line of an ignore file. It returns false for blank
+// lines and comments.
+func parseIgnoreRule(base, line string) (ignoreRule, bool) {
+	line = strings.TrimRight(strings.TrimSuffix(line, "\r"), " ")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	r := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	r.anchored = strings.Contains(line, "/")
+	r.pattern = strings.TrimPrefix(line, "/")
+	return r, r.pattern != ""
+}
+
+// matches reports whether the rule matches the slash-separated path below the root
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, r.base+"/")
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// matchSegments matches path elements against glob elements, where "**" matches
+// any number of elements. A trailing "**" matches everything inside a directory,
+// but not the directory itself.
+func matchSegments(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return len(elems) > 0
+			}
+			for i := range len(elems) + 1 {
+				if matchSegments(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// ignoreMatcher decides which paths of a directory are not copied, following the
+// ignore files found in the directory and its subdirectories, and the --exclude
+// and --include flags, which take precedence over the ignore files
+type ignoreMatcher struct {
+	root        string
+	ignoreFiles []string
+	flags       []ignoreRule
+	rules       map[string][]ignoreRule // Rules of the ignore files of each directory
+}
+
+// newIgnoreMatcher creates a matcher for the directory at root
+func newIgnoreMatcher(root string, ignoreFiles, excludes, includes []string) *ignoreMatcher {
+	im := &ignoreMatcher{root: root, ignoreFiles: ignoreFiles, rules: make(map[string][]ignoreRule)}
+	for _, pattern := range excludes {
+		if r, ok := parseIgnoreRule("", pattern); ok {
+			im.flags = append(im.flags, r)
+		}
+	}
+	for _, pattern := range includes {
+		if r, ok := parseIgnoreRule("", pattern); ok {
+			r.negate = !r.negate
+			im.flags = append(im.flags, r)
+		}
+	}
+	return im
+}
+
+// dirRules returns the rules of the ignore files in the given directory, reading
+// them on first use
+func (im *ignoreMatcher) dirRules(dir string) ([]ignoreRule, error) {
+	if rules, ok := im.rules[dir]; ok {
+		return rules, nil
+	}
+	var rules []ignoreRule
+	for _, name := range im.ignoreFiles {
+		raw, err := os.ReadFile(filepath.Join(im.root, filepath.FromSlash(dir), name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading ignore file: %v", err)
+		}
+		base := dir
+		if base == "." {
+			base = ""
+		}
+		for _, line := range strings.Split(string(raw), "\n") {
+			if r, ok := parseIgnoreRule(base, line); ok {
+				rules = append(rules, r)
+			}
+		}
+	}
+	im.rules[dir] = rules
+	return rules, nil
+}
+
+// excluded reports whether the slash-separated path below the root is not copied.
+// The last matching rule wins, rules of deeper directories override those of their
+// parents, and the flags override all ignore files. Like git, the paths inside an
+// excluded directory are never visited, so they cannot be included again.
+func (im *ignoreMatcher) excluded(rel string, isDir bool) (bool, error) {
+	var rules []ignoreRule
+	elems := strings.Split(rel, "/")
+	for i := range elems {
+		dir := "."
+		if i > 0 {
+			dir = strings.Join(elems[:i], "/")
+		}
+		dirRules, err := im.dirRules(dir)
+		if err != nil {
+			return false, err
+		}
+		rules = append(rules, dirRules...)
+	}
+	rules = append(rules, im.flags...)
+
+	excluded := false
+	for _, r := range rules {
+		if r.matches(rel, isDir) {
+			excluded = !r.negate
+		}
+	}
+	return excluded, nil
+}
+
+// isGitDir reports whether the slash-separated path is a .git directory or inside one
+func isGitDir(rel string) bool {
+	for _, elem := range strings.Split(rel, "/") {
+		if elem == ".git" {
+			return true
+		}
+	}
+	return false
+}
+
+// pathSet holds slash-separated paths relative to a directory, e.g. the paths that
+// were left out of a copy
+type pathSet map[string]bool
+
+// contains reports whether the path or one of its parent directories is in the set
+func (ep pathSet) contains(rel string) bool {
+	for p := filepath.ToSlash(rel); p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if ep[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// copyTree copies the source directory to the target, leaving out the paths excluded
+// by the matcher and, unless the git mode keeps it, the .git directory. It returns
+// the paths that were left out.
+func copyTree(sourceDir, targetDir string, im *ignoreMatcher, gitMode GitMode) (pathSet, error) {
+	excluded := make(pathSet)
+	err := cp.Copy(sourceDir, targetDir, cp.Options{
+		Skip: func(info os.FileInfo, src, _ string) (bool, error) {
+			rel := filepath.ToSlash(relativeTo(sourceDir, src))
+			if rel == "." {
+				return false, nil
+			}
+			if isGitDir(rel) {
+				// Ignore rules never apply to the repository itself
+				if gitMode != GitKeep {
+					excluded[rel] = true
+				}
+				return gitMode != GitKeep, nil
+			}
+			skip, err := im.excluded(rel, info.IsDir())
+			if skip {
+				excluded[rel] = true
+			}
+			return skip, err
+		},
+	})
+	return excluded, err
+}
+
+// initFreshRepository creates a new repository in the target directory holding a
+// single commit of the masked tree, on the branch checked out in the source if it is
+// a repository. If a synced target already holds such a repository, the changes are
+// added as a new commit, if there are any. It returns the ID of the commit.
+func initFreshRepository(ctx context.Context, sourceDir, targetDir string) (string, error) {
+	args := []string{"init", "--quiet"}
+	if branch, err := runGit(ctx, sourceDir, "symbolic-ref", "--quiet", "--short", "HEAD"); err == nil {
+		args = append(args, "--initial-branch="+branch)
+	}
+	if _, err := runGit(ctx, targetDir, args...); err != nil {
+		return "", err
+	}
+	if _, err := runGit(ctx, targetDir, "add", "--all"); err != nil {
+		return "", err
+	}
+	if head, err := runGit(ctx, targetDir, "rev-parse", "--verify", "--quiet", "HEAD"); err == nil {
+		if _, err := runGit(ctx, targetDir, "diff", "--cached", "--quiet"); err == nil {
+			return head, nil // nothing changed since the last sync
+		}
+	}
+
+	name := sourceDir
+	if abs, err := filepath.Abs(sourceDir); err == nil {
+		name = abs
+	}
+	commit := []string{"commit", "--quiet", "--allow-empty", "--no-verify", "--message", "Masked copy of " + filepath.Base(name)}
+	if _, err := runGit(ctx, targetDir, "config", "user.email"); err != nil {
+		// Commit without an identity configured, e.g. in CI
+		commit = append([]string{"-c", "user.name=credential-masker", "-c", "user.email=credential-masker@localhost"}, commit...)
+	}
+	if _, err := runGit(ctx, targetDir, commit...); err != nil {
+		return "", err
+	}
+	return runGit(ctx, targetDir, "rev-parse", "HEAD")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCopyTree(t *testing.T) {
+	files := map[string]string{
+		".git/config":               "[remote]\n",
+		".gitignore":                "node_modules/\n/dist\n*.log\n!keep.log\n",
+		".maskerignore":             "fixtures/**\n",
+		"main.go":                   "package main\n",
+		"app.log":                   "log\n",
+		"keep.log":                  "log\n",
+		"dist/app.js":               "bundle\n",
+		"web/dist/index.html":       "page\n",
+		"web/node_modules/x/x.js":   "dependency\n",
+		"web/.gitignore":            "*.tmp\n",
+		"web/cache.tmp":             "cache\n",
+		"fixtures/secret.txt":       "password=s3cr3t\n",
+		"docs/private/notes.md":     "notes\n",
+		"docs/private/.env.example": "TOKEN=\n",
+	}
+
+	tests := []struct {
+		name      string
+		gitignore bool
+		excludes  []string
+		includes  []string
+		gitMode   GitMode
+		expected  []string
+	}{
+		{
+			name:      "ignore files",
+			gitignore: true,
+			gitMode:   GitDrop,
+			expected:  []string{".gitignore", ".maskerignore", "docs/private/.env.example", "docs/private/notes.md", "keep.log", "main.go", "web/.gitignore", "web/dist/index.html"},
+		},
+		{
+			name:      "flags override ignore files",
+			gitignore: true,
+			excludes:  []string{"docs/private/"},
+			includes:  []string{"app.log"},
+			gitMode:   GitKeep,
+			expected:  []string{".git/config", ".gitignore", ".maskerignore", "app.log", "keep.log", "main.go", "web/.gitignore", "web/dist/index.html"},
+		},
+		{
+			name:     "without gitignore",
+			excludes: []string{"**/node_modules"},
+			gitMode:  GitDrop,
+			expected: []string{".gitignore", ".maskerignore", "app.log", "dist/app.js", "docs/private/.env.example", "docs/private/notes.md", "keep.log", "main.go", "web/.gitignore", "web/cache.tmp", "web/dist/index.html"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sourceDir := filepath.Join(t.TempDir(), "source")
+			targetDir := filepath.Join(t.TempDir(), "target")
+			for name, content := range files {
+				path := filepath.Join(sourceDir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatalf("Failed to create directory of %s: %v", name, err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+					t.Fatalf("Failed to write %s: %v", name, err)
+				}
+			}
+
+			ignoreFiles := []string{maskerIgnoreFile}
+			if tt.gitignore {
+				ignoreFiles = append([]string{".gitignore"}, ignoreFiles...)
+			}
+			excluded, err := copyTree(sourceDir, targetDir, newIgnoreMatcher(sourceDir, ignoreFiles, tt.excludes, tt.includes), tt.gitMode)
+			if err != nil {
+				t.Fatalf("copyTree failed: %v", err)
+			}
+
+			var copied []string
+			err = filepath.WalkDir(targetDir, func(path string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					copied = append(copied, filepath.ToSlash(relativeTo(targetDir, path)))
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatalf("Failed to walk target: %v", err)
+			}
+			slices.Sort(copied)
+			if !slices.Equal(copied, tt.expected) {
+				t.Errorf("Expected copied files\n%v\nbut got\n%v", tt.expected, copied)
+			}
+
+			// Findings in files that were left out are recognized through their directories
+			for name := range files {
+				if slices.Contains(copied, name) == excluded.contains(name) {
+					t.Errorf("Expected %s to be reported as excluded: %t", name, !slices.Contains(copied, name))
+				}
+			}
+		})
+	}
+}
+
+func TestInitFreshRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	sourceDir := t.TempDir()
+	targetDir := t.TempDir()
+	gitTest(t, ".", "init", "--quiet", "--initial-branch=trunk", sourceDir)
+	if err := os.WriteFile(filepath.Join(targetDir, "config.txt"), []byte("password=<password>\n"), 0600); err != nil {
+		t.Fatalf("Failed to write config.txt: %v", err)
+	}
+
+	commit, err := initFreshRepository(context.Background(), sourceDir, targetDir)
+	if err != nil {
+		t.Fatalf("initFreshRepository failed: %v", err)
+	}
+	if got := gitTest(t, targetDir, "rev-list", "--all"); got != commit {
+		t.Errorf("Expected a single commit %s, got %q", commit, got)
+	}
+	if got := gitTest(t, targetDir, "symbolic-ref", "--short", "HEAD"); got != "trunk" {
+		t.Errorf("Expected the branch of the source, got %q", got)
+	}
+	if got := gitTest(t, targetDir, "show", "HEAD:config.txt"); got != "password=<password>" {
+		t.Errorf("Expected the masked tree to be committed, got %q", got)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// base64TokenPattern matches runs of base64 or base64url characters, which may
+// encode a secret along with other data, e.g. user:password in a Basic auth header
+var base64TokenPattern = regexp.MustCompile(`[A-Za-z0-9+/_-]{4,}={0,2}`)
+
+// maskedSecret is a secret that was located in a text, along with its placeholder
+type maskedSecret struct {
+	f           finding
+	placeholder string
+}
+
+// escapedEncoding is an encoding that escapes a secret in place, such that the
+// escaped secret can be searched as is
+type escapedEncoding struct {
+	name   string
+	encode func(string) string
+}
+
+// escapedEncodings are the encodings that may hold a secret besides base64. JSON
+// escaping is left to the structured formats if the file has one.
+func escapedEncodings(structured bool) []escapedEncoding {
+	encodings := []escapedEncoding{
+		{name: "hex", encode: func(s string) string { return hex.EncodeToString([]byte(s)) }},
+		{name: "hex", encode: func(s string) string { return strings.ToUpper(hex.EncodeToString([]byte(s))) }},
+		{name: "url", encode: url.QueryEscape},
+		{name: "url", encode: url.PathEscape},
+	}
+	if !structured {
+		encodings = append(encodings, escapedEncoding{name: "json", encode: func(s string) string {
+			quoted, _ := json.Marshal(s)
+			return string(quoted[1 : len(quoted)-1])
+		}})
+	}
+	return encodings
+}
+
+// base64Token is a base64 token of a text that decodes to valid data
+type base64Token struct {
+	span
+	enc      *base64.Encoding
+	encoding string // "base64" or "base64url"
+	decoded  string
+}
+
+// base64Tokens returns the base64 tokens of the text outside of the taken spans
+func base64Tokens(text string, taken []replacement) []base64Token {
+	var tokens []base64Token
+	for _, loc := range base64TokenPattern.FindAllStringIndex(text, -1) {
+		s := span{start: loc[0], end: loc[1]}
+		if overlapsAny(s, taken) {
+			continue
+		}
+		raw := text[s.start:s.end]
+		enc, encoding := base64.StdEncoding, "base64"
+		if strings.ContainsAny(raw, "-_") {
+			enc, encoding = base64.URLEncoding, "base64url"
+		}
+		if len(raw)%4 != 0 {
+			// Unpadded, so the masked token is written without padding as well
+			enc = enc.WithPadding(base64.NoPadding)
+		}
+		decoded, err := enc.DecodeString(raw)
+		if err != nil {
+			continue
+		}
+		tokens = append(tokens, base64Token{span: s, enc: enc, encoding: encoding, decoded: string(decoded)})
+	}
+	return tokens
+}
+
+// overlapsAny reports whether the span overlaps one of the replacements
+func overlapsAny(s span, replacements []replacement) bool {
+	for _, r := range replacements {
+		if s.start < r.end && r.start < s.end {
+			return true
+		}
+	}
+	return false
+}
+
+// encodedReplacements locates the encoded copies of the masked secrets anywhere in
+// the text and returns the spans to replace along with a derived finding for each
+// copy. The placeholder is written in the encoding of the copy, so the text keeps
+// decoding, e.g. a Kubernetes Secret stays valid base64. Base64 tokens holding a
+// secret along with other data are decoded, masked and encoded again as a whole,
+// so copies are found at any alignment. The position of an offset of the text in
+// the file is given by position.
+func (m *Masker) encodedReplacements(text string, position func(offset int) (int, int), path string, structured bool, masked []maskedSecret, taken []replacement) ([]replacement, []finding) {
+	var replacements []replacement
+	var derived []finding
+	add := func(ms maskedSecret, s span, encoding, placeholder string) {
+		d := ms.f
+		d.DerivedFrom = ms.f.ID
+		d.Encoding = encoding
+		d.Fingerprint = ""
+		d.Secret = text[s.start:s.end]
+		d.Match = d.Secret
+		d.StartLine, d.StartColumn = position(s.start)
+		d.EndLine, d.EndColumn = position(s.end - 1)
+		d.ID = m.ids.id(d, filepath.ToSlash(relativeTo(m.targetDir, path)))
+
+		replacement := replacement{span: s, text: placeholder}
+		replacements = append(replacements, replacement)
+		taken = append(taken, replacement)
+		derived = append(derived, d)
+		m.recordMasked(path, placeholder, d)
+		m.logger.Debug("Finding %s (%s) in %s: masked %s copy at line %d as derived finding %s", ms.f.ID, ms.f.RuleID, path, encoding, d.StartLine, d.ID)
+	}
+
+	for _, ms := range masked {
+		for _, e := range escapedEncodings(structured) {
+			encoded := e.encode(ms.f.Secret)
+			if encoded == ms.f.Secret {
+				continue
+			}
+			for _, s := range findAll(text, encoded, 0, len(text)) {
+				if !overlapsAny(s, taken) {
+					add(ms, s, e.name, e.encode(ms.placeholder))
+				}
+			}
+		}
+	}
+
+	for _, t := range base64Tokens(text, taken) {
+		decoded := t.decoded
+		var owner *maskedSecret
+		for i, ms := range masked {
+			if strings.Contains(decoded, ms.f.Secret) {
+				decoded = strings.ReplaceAll(decoded, ms.f.Secret, ms.placeholder)
+				if owner == nil {
+					owner = &masked[i]
+				}
+			}
+		}
+		if owner == nil {
+			continue
+		}
+		add(*owner, t.span, t.encoding, t.enc.EncodeToString([]byte(decoded)))
+	}
+	return replacements, derived
+}
+
+// recordDerived remembers the derived findings of a file, to report them along with
+// the findings they were derived from
+func (m *Masker) recordDerived(path string, derived []finding) {
+	if len(derived) == 0 {
+		return
+	}
+	m.derivedMu.Lock()
+	defer m.derivedMu.Unlock()
+
+	// Findings inside archives are grouped by the archive
+	file, _ := splitArchivePath(path)
+	m.derived[file] = append(m.derived[file], derived...)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// notebook returns a notebook of a code cell with two source lines and a stream output
+func notebook(first, second, output string) string {
+	return "{\n \"cells\": [\n  {\n   \"cell_type\": \"code\",\n   \"execution_count\": 1,\n   \"metadata\": {},\n" +
+		"   \"source\": [\n" +
+		"    " + first + "\n" +
+		"    " + second + "\n" +
+		"   ],\n" +
+		"   \"outputs\": [{\"name\": \"stdout\", \"output_type\": \"stream\", \"text\": [" + output + "]}]\n" +
+		"  }\n ],\n \"metadata\": {},\n \"nbformat\": 4,\n \"nbformat_minor\": 5\n}\n"
+}
+
+func TestMasker_HandleText_EncodedVariants(t *testing.T) {
+	secret := "s3cr3t pass!"
+	b64 := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		line      int
+		expected  string
+		encodings []string
+	}{
+		{
+			name: "plain text",
+			file: "notes.txt",
+			content: "password=" + secret + "\n" +
+				"Authorization: Basic " + b64([]byte("admin:"+secret)) + "\n" +
+				"url=https://db.local/?password=" + url.QueryEscape(secret) + "\n" +
+				"hex=" + hex.EncodeToString([]byte(secret)) + "\n",
+			line: 1,
+			expected: "password=<password>\n" +
+				"Authorization: Basic " + b64([]byte("admin:<password>")) + "\n" +
+				"url=https://db.local/?password=" + url.QueryEscape("<password>") + "\n" +
+				"hex=" + hex.EncodeToString([]byte("<password>")) + "\n",
+			encodings: []string{"base64", "hex", "url"},
+		},
+		{
+			name: "kubernetes secret",
+			file: "secret.yaml",
+			content: "apiVersion: v1\nkind: Secret\n" +
+				"stringData:\n  password: \"" + secret + "\"\n" +
+				"data:\n  password: " + b64([]byte(secret)) + "\n",
+			line: 4,
+			expected: "apiVersion: v1\nkind: Secret\n" +
+				"stringData:\n  password: \"<password>\"\n" +
+				"data:\n  password: " + b64([]byte("<password>")) + "\n",
+			encodings: []string{"base64"},
+		},
+		{
+			name: "notebook",
+			file: "analysis.ipynb",
+			content: notebook(
+				`"password = \"`+secret+`\"\n",`,
+				`"auth = \"`+b64([]byte("admin:"+secret))+`\"\n"`,
+				`"`+hex.EncodeToString([]byte(secret))+`\n"`),
+			line: 8,
+			expected: notebook(
+				`"password = \"<password>\"\n",`,
+				`"auth = \"`+b64([]byte("admin:<password>"))+`\"\n"`,
+				`"`+hex.EncodeToString([]byte("<password>"))+`\n"`),
+			encodings: []string{"base64", "hex"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			testFilePath := filepath.Join(tmpDir, tt.file)
+			if err := os.WriteFile(testFilePath, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("Failed to write test file: %v", err)
+			}
+			f := finding{RuleID: "password", StartLine: tt.line, EndLine: tt.line, Secret: secret, File: testFilePath}
+
+			masker := NewMasker(tmpDir, tmpDir, []finding{f}, MaskerOptions{PlaceholderMask: "<%[2]s>", MatchMode: MatchPosition, MaskEncoded: true}, Default())
+			results := masker.Process()
+			if errs := masker.Errors(); len(errs) > 0 {
+				t.Fatalf("Process failed: %v", errs)
+			}
+
+			modifiedContent, err := os.ReadFile(testFilePath)
+			if err != nil {
+				t.Fatalf("Failed to read modified file: %v", err)
+			}
+			if string(modifiedContent) != tt.expected {
+				t.Errorf("Expected content to be\n%q\nbut got\n%q", tt.expected, string(modifiedContent))
+			}
+
+			// Every encoded copy is reported as a finding derived from the original one
+			reported := results[testFilePath]
+			if len(reported) != len(tt.encodings)+1 {
+				t.Fatalf("Expected %d findings, got %d: %+v", len(tt.encodings)+1, len(reported), reported)
+			}
+			original := reported[0]
+			var encodings []string
+			ids := map[string]bool{original.ID: true}
+			for _, d := range reported[1:] {
+				if d.DerivedFrom != original.ID {
+					t.Errorf("Expected finding %s to be derived from %s, got %q", d.ID, original.ID, d.DerivedFrom)
+				}
+				if ids[d.ID] {
+					t.Errorf("Expected derived finding to have its own ID, got %s twice", d.ID)
+				}
+				ids[d.ID] = true
+				encodings = append(encodings, d.Encoding)
+			}
+			slices.Sort(encodings)
+			if !slices.Equal(encodings, tt.encodings) {
+				t.Errorf("Expected derived encodings %v, got %v", tt.encodings, encodings)
+			}
+		})
+	}
+}
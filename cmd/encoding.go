@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// sniffLength is the number of bytes the encoding heuristics look at
+const sniffLength = 8192
+
+// textEncoding is a character encoding files are decoded from for masking and
+// re-encoded to afterwards
+type textEncoding struct {
+	name string
+	enc  encoding.Encoding // nil for UTF-8, auto and binary
+}
+
+var (
+	// encAuto detects the encoding of each file
+	encAuto = textEncoding{name: "auto"}
+	// encBinary treats files as binary, so they are replaced as a whole
+	encBinary = textEncoding{name: "binary"}
+
+	encUTF8        = textEncoding{name: "utf-8"}
+	encUTF16LE     = textEncoding{name: "utf-16le", enc: unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)}
+	encUTF16BE     = textEncoding{name: "utf-16be", enc: unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)}
+	encLatin1      = textEncoding{name: "iso-8859-1", enc: charmap.ISO8859_1}
+	encWindows1252 = textEncoding{name: "windows-1252", enc: charmap.Windows1252}
+)
+
+// String returns the name of the encoding
+func (te textEncoding) String() string {
+	return te.name
+}
+
+// ParseTextEncoding parses the name of an encoding, as used in policies
+func ParseTextEncoding(name string) (textEncoding, error) {
+	switch strings.ToLower(name) {
+	case "", "auto":
+		return encAuto, nil
+	case "binary":
+		return encBinary, nil
+	case "utf-8", "utf8":
+		return encUTF8, nil
+	case "utf-16le", "utf16le":
+		return encUTF16LE, nil
+	case "utf-16be", "utf16be":
+		return encUTF16BE, nil
+	case "iso-8859-1", "latin-1", "latin1":
+		return encLatin1, nil
+	case "windows-1252", "cp1252":
+		return encWindows1252, nil
+	default:
+		return encAuto, fmt.Errorf("unknown encoding: %s", name)
+	}
+}
+
+// decode converts the bytes of a file to UTF-8. The text must encode back to the
+// very same bytes, otherwise masking would change more than the secrets.
+func (te textEncoding) decode(buf []byte) (string, error) {
+	if te.enc == nil {
+		if !utf8.Valid(buf) {
+			return "", fmt.Errorf("file is not valid %s", te.name)
+		}
+		return string(buf), nil
+	}
+
+	text, err := te.enc.NewDecoder().Bytes(buf)
+	if err != nil {
+		return "", fmt.Errorf("error decoding %s: %v", te.name, err)
+	}
+	if roundTrip, err := te.enc.NewEncoder().Bytes(text); err != nil || !bytes.Equal(roundTrip, buf) {
+		return "", fmt.Errorf("file is not valid %s", te.name)
+	}
+	return string(text), nil
+}
+
+// encode converts UTF-8 text back to the encoding
+func (te textEncoding) encode(text string) ([]byte, error) {
+	if te.enc == nil {
+		return []byte(text), nil
+	}
+	buf, err := te.enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding %s, does the placeholder contain characters it cannot represent? %v", te.name, err)
+	}
+	return buf, nil
+}
+
+// detectEncoding guesses the encoding of a file from its byte order mark, the
+// distribution of zero bytes and the range of its bytes. Files that look like
+// none of the supported text encodings are binary.
+func detectEncoding(buf []byte) textEncoding {
+	switch {
+	case bytes.HasPrefix(buf, []byte{0xff, 0xfe}):
+		return decodable(encUTF16LE, buf)
+	case bytes.HasPrefix(buf, []byte{0xfe, 0xff}):
+		return decodable(encUTF16BE, buf)
+	}
+
+	// UTF-16 without BOM: text in Latin scripts has a zero byte in every other position.
+	// Zero bytes are valid UTF-8, so this is checked first.
+	sample := buf[:min(len(buf), sniffLength)]
+	if len(buf)%2 == 0 && bytes.IndexByte(sample, 0) >= 0 {
+		var evenZeros, oddZeros int
+		for i, b := range sample {
+			if b != 0 {
+				continue
+			}
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+		pairs := len(sample) / 2
+		var te textEncoding
+		switch {
+		case oddZeros*10 >= pairs*3 && evenZeros*20 <= pairs:
+			te = encUTF16LE
+		case evenZeros*10 >= pairs*3 && oddZeros*20 <= pairs:
+			te = encUTF16BE
+		}
+		if te.enc != nil {
+			// Binary data with many zero bytes decodes as well, but not to text
+			if text, err := te.decode(buf); err == nil && printable(text) {
+				return te
+			}
+		}
+	}
+
+	if utf8.Valid(buf) {
+		return encUTF8
+	}
+
+	// Single-byte encodings: mostly ASCII, no control characters besides whitespace
+	var controls, high, c1 int
+	for _, b := range sample {
+		switch {
+		case b >= 0x80 && b < 0xa0:
+			high++
+			c1++
+		case b >= 0x80:
+			high++
+		case b < 0x20 && !strings.ContainsRune("\t\n\v\f\r\x1b", rune(b)), b == 0x7f:
+			controls++
+		}
+	}
+	if controls > 0 || high*10 > len(sample)*3 {
+		return encBinary
+	}
+	if c1 > 0 {
+		// Latin-1 has control characters in 0x80-0x9f, Windows-1252 has printable ones
+		if te := decodable(encWindows1252, buf); te.name != encBinary.name {
+			return te
+		}
+	}
+	return decodable(encLatin1, buf)
+}
+
+// decodable returns the encoding if the file decodes losslessly in it, and binary otherwise
+func decodable(te textEncoding, buf []byte) textEncoding {
+	if _, err := te.decode(buf); err != nil {
+		return encBinary
+	}
+	return te
+}
+
+// printable reports whether the text has no control characters besides whitespace
+func printable(text string) bool {
+	for _, r := range text {
+		if (r < 0x20 && !strings.ContainsRune("\t\n\v\f\r\x1b", r)) || (r >= 0x7f && r < 0xa0) {
+			return false
+		}
+	}
+	return true
+}
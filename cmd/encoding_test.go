@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  []byte
+		expected textEncoding
+	}{
+		{"utf-8", []byte("password=geheim\n"), encUTF8},
+		{"utf-16le with bom", mustEncode(t, encUTF16LE, "\ufeffWindows Registry Editor Version 5.00\r\n"), encUTF16LE},
+		{"utf-16be with bom", mustEncode(t, encUTF16BE, "\ufeff$password = 'geheim'\r\n"), encUTF16BE},
+		{"utf-16le without bom", mustEncode(t, encUTF16LE, "$password = 'geheim'\r\n"), encUTF16LE},
+		{"latin-1", mustEncode(t, encLatin1, "passwort=gehüm\n"), encLatin1},
+		{"windows-1252", mustEncode(t, encWindows1252, "password=€uro\n"), encWindows1252},
+		{"binary", []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0x00, 0x00, 0x0d}, encBinary},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectEncoding(tt.content); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMasker_HandleEncodedText(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		file     string
+		enc      textEncoding
+		content  string
+		expected string
+		policies Policies
+	}{
+		{
+			name:     "utf-16le registry file",
+			file:     "settings.reg",
+			enc:      encUTF16LE,
+			content:  "\ufeffWindows Registry Editor Version 5.00\r\n\r\n\"Password\"=\"s3cr3t\"\r\n",
+			expected: "\ufeffWindows Registry Editor Version 5.00\r\n\r\n\"Password\"=\"<password>\"\r\n",
+		},
+		{
+			name:     "latin-1 properties file",
+			file:     "app.properties",
+			enc:      encLatin1,
+			content:  "# Schlüssel\ndb.password=s3cr3t\n",
+			expected: "# Schlüssel\ndb.password=<password>\n",
+		},
+		{
+			// Without the policy this would be detected as Latin-1
+			name:     "encoding from policy",
+			file:     "legacy/app.ini",
+			enc:      encWindows1252,
+			content:  "; Kosten in €\npassword=s3cr3t\n",
+			expected: "; Kosten in €\npassword=<password>\n",
+			policies: Policies{Paths: map[string]Policy{"legacy": {Encoding: "windows-1252"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testFilePath := filepath.Join(tmpDir, tt.file)
+			if err := os.MkdirAll(filepath.Dir(testFilePath), 0755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			if err := os.WriteFile(testFilePath, mustEncode(t, tt.enc, tt.content), 0600); err != nil {
+				t.Fatalf("Failed to write test file: %v", err)
+			}
+			findings := []finding{{RuleID: "password", StartLine: 3, EndLine: 3, Secret: "s3cr3t", File: testFilePath, ID: "test-id"}}
+
+			masker := NewMasker(tmpDir, tmpDir, findings, MaskerOptions{PlaceholderMask: "<%[2]s>", Policies: tt.policies}, Default())
+			handler, err := masker.ParseFileType(testFilePath, findings)
+			if err != nil {
+				t.Fatalf("ParseFileType failed: %v", err)
+			}
+			if err := handler(); err != nil {
+				t.Fatalf("Handler failed: %v", err)
+			}
+
+			modifiedContent, err := os.ReadFile(testFilePath)
+			if err != nil {
+				t.Fatalf("Failed to read modified file: %v", err)
+			}
+			if expected := mustEncode(t, tt.enc, tt.expected); string(modifiedContent) != string(expected) {
+				t.Errorf("Expected content to be\n%q\nbut got\n%q", expected, modifiedContent)
+			}
+		})
+	}
+}
+
+func mustEncode(t *testing.T, enc textEncoding, text string) []byte {
+	t.Helper()
+	buf, err := enc.encode(text)
+	if err != nil {
+		t.Fatalf("Failed to encode %q as %s: %v", text, enc, err)
+	}
+	return buf
+}
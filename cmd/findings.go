@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1" // #nosec G505 -- compared against detect-secrets hashes
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// finding represents a credential or secret finding from gitleaks
+type finding struct {
+	RuleID       string   `json:"ruleID"`                 // ID of the rule that triggered this finding
+	StartLine    int      `json:"startLine"`              // Line where the finding starts
+	EndLine      int      `json:"endLine"`                // Line where the finding ends
+	StartColumn  int      `json:"startColumn"`            // Column (1-based) where the finding starts
+	EndColumn    int      `json:"endColumn"`              // Column (1-based, inclusive) where the finding ends
+	Match        string   `json:"match"`                  // The matched text containing the secret
+	Secret       string   `json:"secret"`                 // The actual secret value
+	File         string   `json:"file"`                   // Path to the file containing the secret
+	Entropy      float64  `json:"entropy"`                // Entropy score of the secret
+	Fingerprint  string   `json:"fingerprint"`            // Unique identifier for this finding
+	ID           string   `json:"id"`                     // Unique ID for this finding
+	Verified     bool     `json:"verified"`               // Whether the scanner verified the secret is live
+	HashedSecret string   `json:"hashedSecret,omitempty"` // SHA-1 of the secret, for scanners that do not report it in plaintext
+	Scanners     []string `json:"scanners,omitempty"`     // Scanners that reported this finding
+	Commit       string   `json:"commit,omitempty"`       // Commit the secret was found in, for git scans
+	Author       string   `json:"author,omitempty"`       // Author of the commit
+	Email        string   `json:"email,omitempty"`        // Email of the author of the commit
+	Date         string   `json:"date,omitempty"`         // Date of the commit
+	Message      string   `json:"message,omitempty"`      // Message of the commit
+	DerivedFrom  string   `json:"derivedFrom,omitempty"`  // ID of the finding whose secret this is an encoded copy of
+	Encoding     string   `json:"encoding,omitempty"`     // Encoding of the copy, for derived findings
+}
+
+// FindingsFormat represents the format of a findings report
+type FindingsFormat int
+
+const (
+	// FormatAuto detects the format from the contents of the report
+	FormatAuto FindingsFormat = iota
+	// FormatGitleaks is the native gitleaks JSON array
+	FormatGitleaks
+	// FormatSARIF is a SARIF 2.1.0 log
+	FormatSARIF
+	// FormatTruffleHog is the newline-delimited JSON output of TruffleHog v3
+	FormatTruffleHog
+	// FormatDetectSecrets is a Yelp detect-secrets baseline
+	FormatDetectSecrets
+)
+
+// String returns the string representation of the findings format
+func (ff FindingsFormat) String() string {
+	switch ff {
+	case FormatAuto:
+		return "auto"
+	case FormatGitleaks:
+		return "gitleaks"
+	case FormatSARIF:
+		return "sarif"
+	case FormatTruffleHog:
+		return "trufflehog"
+	case FormatDetectSecrets:
+		return "detect-secrets"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseFindingsFormat parses a string into a FindingsFormat
+func ParseFindingsFormat(format string) (FindingsFormat, error) {
+	switch strings.ToLower(format) {
+	case "auto":
+		return FormatAuto, nil
+	case "gitleaks", "json":
+		return FormatGitleaks, nil
+	case "sarif":
+		return FormatSARIF, nil
+	case "trufflehog", "jsonl":
+		return FormatTruffleHog, nil
+	case "detect-secrets", "baseline":
+		return FormatDetectSecrets, nil
+	default:
+		return FormatAuto, fmt.Errorf("unknown findings format: %s", format)
+	}
+}
+
+// loadFindings loads and parses the findings file in the given format
+func loadFindings(path string, format FindingsFormat) ([]finding, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading findings file: %v", err)
+	}
+
+	if format == FormatAuto {
+		if format, err = detectFindingsFormat(raw); err != nil {
+			return nil, fmt.Errorf("error detecting format of %s: %v", path, err)
+		}
+	}
+
+	switch format {
+	case FormatGitleaks:
+		return parseGitleaks(raw)
+	case FormatSARIF:
+		return parseSARIF(raw)
+	case FormatTruffleHog:
+		return parseTruffleHog(raw)
+	case FormatDetectSecrets:
+		return parseDetectSecrets(raw)
+	default:
+		return nil, fmt.Errorf("unsupported findings format: %s", format)
+	}
+}
+
+// mergeFindings concatenates the findings of several reports, de-duplicating findings
+// of the same secret on the same line of the same file. Scanners are compared by the
+// SHA-1 of the secret, so plaintext findings also match hashed detect-secrets findings.
+func mergeFindings(sourceDir string, reports ...[]finding) []finding {
+	var merged []finding
+	index := make(map[string]int)
+
+	for _, report := range reports {
+		for _, f := range report {
+			key := findingKey(sourceDir, f)
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(merged)
+				merged = append(merged, f)
+				continue
+			}
+
+			// Complete the first finding with what the other scanner knows
+			existing := &merged[i]
+			for _, scanner := range f.Scanners {
+				if !slices.Contains(existing.Scanners, scanner) {
+					existing.Scanners = append(existing.Scanners, scanner)
+				}
+			}
+			existing.Verified = existing.Verified || f.Verified
+			if existing.Secret == "" {
+				existing.Secret = f.Secret
+				existing.Match = f.Match
+			}
+			if existing.StartColumn == 0 && existing.EndColumn == 0 {
+				existing.StartColumn = f.StartColumn
+				existing.EndColumn = f.EndColumn
+			}
+			if existing.Fingerprint == "" {
+				existing.Fingerprint = f.Fingerprint
+			}
+			if existing.Commit == "" {
+				existing.Commit, existing.Author, existing.Email, existing.Date, existing.Message = f.Commit, f.Author, f.Email, f.Date, f.Message
+			}
+		}
+	}
+	return merged
+}
+
+// findingKey identifies a finding by file, line and secret
+func findingKey(sourceDir string, f finding) string {
+	hashed := f.HashedSecret
+	if f.Secret != "" {
+		sum := sha1.Sum([]byte(f.Secret)) // #nosec G401 -- compared against detect-secrets hashes
+		hashed = hex.EncodeToString(sum[:])
+	}
+	return fmt.Sprintf("%s\x00%d\x00%s", targetPath(sourceDir, "", f.File), f.StartLine, strings.ToLower(hashed))
+}
+
+// detectFindingsFormat sniffs the format of a findings report from its contents
+func detectFindingsFormat(raw []byte) (FindingsFormat, error) {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(raw, []byte("\xef\xbb\xbf")))
+	if len(trimmed) == 0 {
+		return FormatAuto, fmt.Errorf("file is empty")
+	}
+
+	switch trimmed[0] {
+	case '[':
+		return FormatGitleaks, nil
+	case '{':
+		// Newline-delimited reports are recognized by their first record
+		first, _, _ := bytes.Cut(trimmed, []byte("\n"))
+		var top map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &top); err != nil {
+			if err := json.Unmarshal(first, &top); err != nil {
+				return FormatAuto, fmt.Errorf("error parsing JSON: %v", err)
+			}
+		}
+		if _, ok := top["runs"]; ok {
+			return FormatSARIF, nil
+		}
+		if _, ok := top["SourceMetadata"]; ok {
+			return FormatTruffleHog, nil
+		}
+		if results, ok := top["results"]; ok && bytes.HasPrefix(bytes.TrimSpace(results), []byte("{")) {
+			return FormatDetectSecrets, nil
+		}
+	}
+	return FormatAuto, fmt.Errorf("unrecognized findings format")
+}
+
+// parseGitleaks parses the native gitleaks JSON report
+func parseGitleaks(raw []byte) ([]finding, error) {
+	var findings []finding
+	if err := json.Unmarshal(raw, &findings); err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %v", err)
+	}
+	for i := range findings {
+		findings[i].Scanners = []string{"gitleaks"}
+	}
+	return findings, nil
+}
+
+// truffleHogLocation is the location of a TruffleHog result for a filesystem or git source
+type truffleHogLocation struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Commit    string `json:"commit"`
+	Email     string `json:"email"`
+	Timestamp string `json:"timestamp"`
+}
+
+// truffleHogResult is a single line of TruffleHog's JSON output
+type truffleHogResult struct {
+	SourceMetadata struct {
+		Data struct {
+			Filesystem *truffleHogLocation `json:"Filesystem"`
+			Git        *truffleHogLocation `json:"Git"`
+		} `json:"Data"`
+	} `json:"SourceMetadata"`
+	DetectorName string `json:"DetectorName"`
+	DecoderName  string `json:"DecoderName"`
+	Verified     bool   `json:"Verified"`
+	Raw          string `json:"Raw"`
+	RawV2        string `json:"RawV2"`
+}
+
+// parseTruffleHog maps TruffleHog's newline-delimited JSON output into findings
+func parseTruffleHog(raw []byte) ([]finding, error) {
+	var findings []finding
+	for i, line := range bytes.Split(raw, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var result truffleHogResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			return nil, fmt.Errorf("error parsing TruffleHog result on line %d: %v", i+1, err)
+		}
+
+		loc := result.SourceMetadata.Data.Filesystem
+		if loc == nil {
+			loc = result.SourceMetadata.Data.Git
+		}
+		if loc == nil || loc.File == "" {
+			return nil, fmt.Errorf("error parsing TruffleHog result on line %d: unsupported source, only filesystem and git are supported", i+1)
+		}
+
+		// Raw is the value found in the file, RawV2 may carry extra context such as the endpoint
+		secret := result.Raw
+		if secret == "" {
+			secret = result.RawV2
+		}
+
+		findings = append(findings, finding{
+			RuleID:    result.DetectorName,
+			StartLine: loc.Line,
+			EndLine:   loc.Line + strings.Count(secret, "\n"),
+			Match:     secret,
+			Secret:    secret,
+			File:      loc.File,
+			Commit:    loc.Commit,
+			Email:     loc.Email,
+			Date:      loc.Timestamp,
+			Verified:  result.Verified,
+			Scanners:  []string{"trufflehog"},
+		})
+	}
+	return findings, nil
+}
+
+// detectSecretsBaseline is the subset of a detect-secrets baseline needed to build findings
+type detectSecretsBaseline struct {
+	Version string `json:"version"`
+	Results map[string][]struct {
+		Type         string `json:"type"`
+		Filename     string `json:"filename"`
+		HashedSecret string `json:"hashed_secret"`
+		IsVerified   bool   `json:"is_verified"`
+		LineNumber   int    `json:"line_number"`
+	} `json:"results"`
+}
+
+// parseDetectSecrets maps the results of a detect-secrets baseline into findings. The
+// baseline only holds the SHA-1 of each secret, which is resolved on the reported line
+// when the file is masked.
+func parseDetectSecrets(raw []byte) ([]finding, error) {
+	var baseline detectSecretsBaseline
+	if err := json.Unmarshal(raw, &baseline); err != nil {
+		return nil, fmt.Errorf("error parsing detect-secrets baseline: %v", err)
+	}
+
+	// Sort file names so findings keep a stable order
+	files := make([]string, 0, len(baseline.Results))
+	for file := range baseline.Results {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var findings []finding
+	for _, file := range files {
+		for _, result := range baseline.Results[file] {
+			path := result.Filename
+			if path == "" {
+				path = file
+			}
+			findings = append(findings, finding{
+				RuleID:       result.Type,
+				StartLine:    result.LineNumber,
+				EndLine:      result.LineNumber,
+				File:         path,
+				Verified:     result.IsVerified,
+				HashedSecret: result.HashedSecret,
+				Scanners:     []string{"detect-secrets"},
+			})
+		}
+	}
+	return findings, nil
+}
+
+// sarifLog is the subset of a SARIF 2.1.0 log needed to build findings
+type sarifLog struct {
+	Version string `json:"version"`
+	Runs    []struct {
+		Tool struct {
+			Driver struct {
+				Name string `json:"name"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []sarifResult `json:"results"`
+	} `json:"runs"`
+}
+
+// sarifResult is a single result of a SARIF run
+type sarifResult struct {
+	RuleID  string `json:"ruleId"`
+	Message struct {
+		Text string `json:"text"`
+	} `json:"message"`
+	Locations []struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+			Region sarifRegion `json:"region"`
+		} `json:"physicalLocation"`
+	} `json:"locations"`
+	Fingerprints        map[string]string `json:"fingerprints"`
+	PartialFingerprints map[string]string `json:"partialFingerprints"`
+}
+
+// sarifRegion is the region of a physical location of a SARIF result
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+	Snippet     struct {
+		Text string `json:"text"`
+	} `json:"snippet"`
+}
+
+// parseSARIF maps the results of a SARIF log into findings, one per physical location
+func parseSARIF(raw []byte) ([]finding, error) {
+	var log sarifLog
+	if err := json.Unmarshal(raw, &log); err != nil {
+		return nil, fmt.Errorf("error parsing SARIF: %v", err)
+	}
+	if len(log.Runs) == 0 {
+		return nil, fmt.Errorf("error parsing SARIF: log has no runs")
+	}
+
+	var findings []finding
+	for _, run := range log.Runs {
+		scanner := strings.ToLower(run.Tool.Driver.Name)
+		if scanner == "" {
+			scanner = "sarif"
+		}
+		for _, result := range run.Results {
+			for _, loc := range result.Locations {
+				region := loc.PhysicalLocation.Region
+				file, err := sarifURIToPath(loc.PhysicalLocation.ArtifactLocation.URI)
+				if err != nil {
+					return nil, fmt.Errorf("error parsing SARIF result %s: %v", result.RuleID, err)
+				}
+
+				endLine := region.EndLine
+				if endLine == 0 {
+					endLine = region.StartLine
+				}
+
+				// SARIF end columns are exclusive, but because the secret is searched
+				// within the reported span, the extra byte does no harm.
+				findings = append(findings, finding{
+					RuleID:      result.RuleID,
+					StartLine:   region.StartLine,
+					EndLine:     endLine,
+					StartColumn: region.StartColumn,
+					EndColumn:   region.EndColumn,
+					Match:       region.Snippet.Text,
+					Secret:      sarifSecret(region),
+					File:        file,
+					Fingerprint: sarifFingerprint(result),
+					Scanners:    []string{scanner},
+				})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// sarifSecret returns the secret of a SARIF region. The snippet should be the text
+// of the region, and gitleaks writes the secret with an inclusive end column, but
+// producers such as Semgrep and GitHub code scanning put the whole lines of the
+// region in it. The secret is only cut from the lines with the columns, which are
+// 1-based and exclusive at the end, if the snippet is provably those lines: its
+// last line goes on past the end column, or it is followed by a line feed.
+// Otherwise the snippet is used as it is, since cutting the secret itself would
+// leave part of it unmasked.
+func sarifSecret(region sarifRegion) string {
+	snippet := region.Snippet.Text
+	start, end := region.StartColumn, region.EndColumn
+	if snippet == "" || start <= 0 || end <= 0 {
+		return snippet
+	}
+	endLine := max(region.EndLine, region.StartLine)
+
+	lines := strings.Split(snippet, "\n")
+	if len(lines) < endLine-region.StartLine+1 {
+		return snippet
+	}
+	first, last := []rune(lines[0]), []rune(lines[endLine-region.StartLine])
+	whole := len(last) > end || len(lines) > endLine-region.StartLine+1 && len(last) >= end-1
+	if start-1 > len(first) || !whole || endLine == region.StartLine && end <= start {
+		return snippet // the text of the region
+	}
+	if endLine == region.StartLine {
+		return string(first[start-1 : end-1])
+	}
+	parts := []string{string(first[start-1:])}
+	parts = append(parts, lines[1:endLine-region.StartLine]...)
+	parts = append(parts, string(last[:end-1]))
+	return strings.Join(parts, "\n")
+}
+
+// sarifURIToPath converts a SARIF artifact URI into a file path
+func sarifURIToPath(uri string) (string, error) {
+	if uri == "" {
+		return "", fmt.Errorf("missing artifact location")
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid artifact URI %q: %v", uri, err)
+	}
+	if u.Scheme != "" && u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported artifact URI scheme %q", u.Scheme)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// sarifFingerprint picks a stable fingerprint for a SARIF result, if the producer provided one
+func sarifFingerprint(result sarifResult) string {
+	for _, fps := range []map[string]string{result.Fingerprints, result.PartialFingerprints} {
+		for _, key := range []string{"gitleaksFingerprint/v1", "matchBasedId/v1", "primaryLocationLineHash"} {
+			if fp, ok := fps[key]; ok {
+				return fp
+			}
+		}
+	}
+	return ""
+}
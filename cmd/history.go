@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// RunMode controls what the masker rewrites
+type RunMode int
+
+const (
+	// ModeTree copies the source directory to the target and masks the copy
+	ModeTree RunMode = iota
+	// ModeHistory rewrites every commit of the source repository into a new
+	// repository at the target, masking the affected files of every commit
+	ModeHistory
+)
+
+// String returns the string representation of the run mode
+func (rm RunMode) String() string {
+	switch rm {
+	case ModeTree:
+		return "tree"
+	case ModeHistory:
+		return "history"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseRunMode parses a string into a RunMode
+func ParseRunMode(mode string) (RunMode, error) {
+	switch strings.ToLower(mode) {
+	case "tree":
+		return ModeTree, nil
+	case "history":
+		return ModeHistory, nil
+	default:
+		return ModeTree, fmt.Errorf("unknown mode: %s", mode)
+	}
+}
+
+// globalMatching returns the policies without their match modes. Line numbers only
+// hold for the commit a finding was reported in, so secrets are searched in the
+// whole file in every other commit.
+func (ps Policies) globalMatching() Policies {
+	global := Policies{Rules: make(map[string]Policy, len(ps.Rules)), Paths: make(map[string]Policy, len(ps.Paths))}
+	for pattern, p := range ps.Rules {
+		p.MatchMode = ""
+		global.Rules[pattern] = p
+	}
+	for pattern, p := range ps.Paths {
+		p.MatchMode = ""
+		global.Paths[pattern] = p
+	}
+	return global
+}
+
+// runGit runs git in dir and returns its output without the trailing newline
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// blobReader reads blobs and other objects of a repository through a long-running git cat-file
+type blobReader struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// newBlobReader starts reading blobs of the repository in dir
+func newBlobReader(ctx context.Context, dir string) (*blobReader, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "cat-file", "--batch")
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting git cat-file: %v", err)
+	}
+	return &blobReader{cmd: cmd, in: in, out: bufio.NewReader(out)}, nil
+}
+
+// read returns the content of the blob with the given object ID
+func (br *blobReader) read(oid string) ([]byte, error) {
+	kind, content, err := br.object(oid)
+	if err != nil {
+		return nil, err
+	}
+	if kind != "blob" {
+		return nil, fmt.Errorf("error reading blob %s: object is a %s", oid, kind)
+	}
+	return content, nil
+}
+
+// object returns the type and content of the object with the given object ID
+func (br *blobReader) object(oid string) (string, []byte, error) {
+	if _, err := fmt.Fprintln(br.in, oid); err != nil {
+		return "", nil, fmt.Errorf("error requesting object %s: %v", oid, err)
+	}
+	header, err := br.out.ReadString('\n')
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading object %s: %v", oid, err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return "", nil, fmt.Errorf("error reading object %s: unexpected header %q", oid, strings.TrimSpace(header))
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading object %s: %v", oid, err)
+	}
+	content := make([]byte, size+1) // followed by a line feed
+	if _, err := io.ReadFull(br.out, content); err != nil {
+		return "", nil, fmt.Errorf("error reading object %s: %v", oid, err)
+	}
+	return fields[1], content[:size], nil
+}
+
+// Close stops git cat-file
+func (br *blobReader) Close() error {
+	br.in.Close()
+	return br.cmd.Wait()
+}
+
+// unquoteGitPath returns a path as written by git fast-export, which quotes paths
+// with special characters C-style
+func unquoteGitPath(p string) string {
+	if strings.HasPrefix(p, `"`) {
+		if unquoted, err := strconv.Unquote(p); err == nil {
+			return unquoted
+		}
+	}
+	return p
+}
+
+// quoteGitPath quotes a path for git fast-import if it needs quoting
+func quoteGitPath(p string) string {
+	if !strings.HasPrefix(p, `"`) && !strings.ContainsAny(p, "\n") {
+		return p
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(p) + `"`
+}
+
+// historyStats counts what a history rewrite changed
+type historyStats struct {
+	commits  int
+	masked   int // File versions that were masked
+	messages int // Commit messages, tag annotations and notes that were masked
+}
+
+// historyRewriter rewrites the stream of git fast-export, writing every file with
+// its masked content
+type historyRewriter struct {
+	m       *Masker
+	blobs   func(oid string) ([]byte, error)
+	masked  map[string]memberEdit // Masked versions of blobs, by object ID
+	clean   map[string]bool       // Object IDs of blobs that hold no secret
+	secrets []finding             // Findings with distinct secrets, to mask in messages
+	commits []string              // Marks of the commits in the order they were written
+	oids    map[string]string     // Original object ID of each commit mark
+	marks   map[string]string     // Mark of each original commit object ID
+	stats   historyStats
+}
+
+// messageSecrets returns the findings whose secrets are masked in commit messages,
+// tag annotations and notes: the findings in commit messages, then the findings
+// in files, since a secret committed to a file may have been pasted into a message
+// as well. Only the first finding of each secret is kept.
+func (m *Masker) messageSecrets() []finding {
+	findings := slices.Clone(m.messages)
+	paths := slices.Sorted(maps.Keys(m.findings))
+	for _, path := range paths {
+		findings = append(findings, m.findings[path]...)
+	}
+
+	var secrets []finding
+	seen := make(map[string]bool)
+	for _, f := range findings {
+		if f.Secret != "" && !seen[f.Secret] {
+			seen[f.Secret] = true
+			secrets = append(secrets, f)
+		}
+	}
+	return secrets
+}
+
+// maskMessage replaces the secrets in a commit message, tag annotation or note with
+// the placeholders of their findings, named after the kind of message instead of
+// a file
+func (hr *historyRewriter) maskMessage(kind, name string, message []byte) ([]byte, error) {
+	text := string(message)
+	var replacements []replacement
+	var errs []error
+	for _, f := range hr.secrets {
+		spans := findAll(text, f.Secret, 0, len(text))
+		if len(spans) == 0 {
+			continue
+		}
+		placeholder, err := hr.m.placeholder(hr.m.targetDir, kind, f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error masking %s %s: %v", kind, name, err))
+			continue
+		}
+		for _, s := range spans {
+			replacements = append(replacements, replacement{span: s, text: placeholder})
+		}
+		hr.m.logger.Debug("Masked finding %s (%s) in %s %s", f.ID, f.RuleID, kind, name)
+	}
+	if len(replacements) == 0 {
+		return message, errors.Join(errs...)
+	}
+	hr.stats.messages++
+	return []byte(applyReplacements(text, replacements)), errors.Join(errs...)
+}
+
+// maskBlob returns how a version of a file is written in the given commit. Whether
+// a blob is masked is decided by its content, not by its path: it is masked with
+// the findings of its path and with every other finding whose secret it holds, so
+// copies of a secret are masked wherever they are, e.g. in a file before it was
+// renamed to the path of its findings or in a copy of it. The first version masked
+// is reused for every path of the blob. Secrets are missing from the versions of a
+// file before they were added, so only failures in the commits the findings were
+// reported in are errors.
+func (hr *historyRewriter) maskBlob(rel, oid, commit string) (memberEdit, error) {
+	if edit, ok := hr.masked[oid]; ok {
+		return edit, nil
+	}
+	content, err := hr.blobs(oid)
+	if err != nil {
+		return memberEdit{}, err
+	}
+	path := filepath.Join(hr.m.targetDir, filepath.FromSlash(rel))
+	reported := hr.m.findings[path]
+	if hr.clean[oid] && len(reported) == 0 {
+		return memberEdit{content: content}, nil
+	}
+
+	findings := slices.Clone(reported)
+	for _, f := range hr.secrets {
+		if hr.m.policyFor(path, f).skips(f) || slices.ContainsFunc(findings, func(other finding) bool { return other.Secret == f.Secret }) {
+			continue
+		}
+		if slices.ContainsFunc(encodedVariants(f.Secret), func(v encodedSecret) bool { return bytes.Contains(content, []byte(v.Value)) }) {
+			f.File = path
+			findings = append(findings, f)
+		}
+	}
+	if len(findings) == 0 {
+		hr.clean[oid] = true
+		return memberEdit{content: content}, nil
+	}
+
+	edit, err := hr.m.maskMember(path, content, findings)
+	if err != nil {
+		inCommit := slices.ContainsFunc(reported, func(f finding) bool { return f.Commit != "" && strings.HasPrefix(commit, f.Commit) })
+		if inCommit {
+			return memberEdit{}, fmt.Errorf("error masking %s in commit %s: %v", rel, commit, err)
+		}
+		hr.m.logger.Debug("Not every finding applies to %s in commit %s: %v", rel, commit, err)
+	}
+	if edit.content == nil && !edit.remove {
+		edit.content = content
+	}
+	if !edit.remove && bytes.Equal(edit.content, content) && edit.note == nil {
+		return edit, nil
+	}
+	hr.masked[oid] = edit
+	hr.stats.masked++
+	return edit, nil
+}
+
+// writeData writes a data command holding the content
+func writeData(w io.Writer, content []byte) error {
+	if _, err := fmt.Fprintf(w, "data %d\n", len(content)); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// rewrite copies the fast-export stream from r to w. File modifications refer to
+// the blobs of the source repository, since the stream is exported without data,
+// and are written with the content of the blob inline, masked if needed.
+func (hr *historyRewriter) rewrite(ctx context.Context, r *bufio.Reader, w io.Writer) error {
+	var command, name, mark, commit string
+	var errs []error
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) && line == "" {
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading git fast-export: %v", err)
+		}
+
+		switch fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4); {
+		case strings.HasPrefix(line, "data "):
+			// Messages are read whole, they may hold lines that look like commands
+			size, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return fmt.Errorf("error parsing git fast-export: invalid data length in %q", line)
+			}
+			content := make([]byte, size)
+			if _, err := io.ReadFull(r, content); err != nil {
+				return fmt.Errorf("error reading git fast-export: %v", err)
+			}
+			switch command {
+			case "commit":
+				content, err = hr.maskMessage("commit", commit, content)
+			case "tag":
+				content, err = hr.maskMessage("tag", name, content)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if err := writeData(w, content); err != nil {
+				return err
+			}
+			if next, err := r.Peek(1); err == nil && next[0] == '\n' {
+				r.Discard(1)
+			}
+			continue
+
+		case fields[0] == "commit", fields[0] == "tag", fields[0] == "reset", fields[0] == "blob":
+			command, name, mark, commit = fields[0], strings.Join(fields[1:], " "), "", ""
+			if command == "commit" {
+				hr.stats.commits++
+			}
+
+		case fields[0] == "mark" && command == "commit":
+			mark = strings.TrimSpace(fields[1])
+			hr.commits = append(hr.commits, mark)
+
+		case fields[0] == "original-oid" && command == "commit":
+			commit = strings.TrimSpace(fields[1])
+			if mark != "" {
+				hr.oids[mark] = commit
+				hr.marks[commit] = mark
+			}
+
+		case (fields[0] == "M" || fields[0] == "D") && command == "commit" && strings.HasPrefix(name, "refs/notes/"):
+			// Notes are files named after the object they annotate, so they are moved
+			// to the rewritten commits along with being masked
+			if err := hr.rewriteNote(w, fields); err != nil {
+				return err
+			}
+			continue
+
+		case fields[0] == "M" && len(fields) == 4 && fields[1] != "160000" && !strings.HasPrefix(fields[2], ":") && fields[2] != "inline":
+			// M <mode> <object ID> <path>, gitlinks refer to commits of other repositories
+			mode, oid, rawPath := fields[1], fields[2], fields[3]
+			rel := unquoteGitPath(rawPath)
+			edit, err := hr.maskBlob(rel, oid, commit)
+			if err != nil {
+				// The file is written as it is, so the run fails
+				errs = append(errs, err)
+				content, readErr := hr.blobs(oid)
+				if readErr != nil {
+					return readErr
+				}
+				edit = memberEdit{content: content}
+			}
+
+			if edit.remove {
+				if _, err := fmt.Fprintf(w, "D %s\n", rawPath); err != nil {
+					return err
+				}
+			} else {
+				if _, err := fmt.Fprintf(w, "M %s inline %s\n", mode, rawPath); err != nil {
+					return err
+				}
+				if err := writeData(w, edit.content); err != nil {
+					return err
+				}
+			}
+			if edit.note != nil {
+				if _, err := fmt.Fprintf(w, "M 100644 inline %s\n", quoteGitPath(rel+".masked.txt")); err != nil {
+					return err
+				}
+				if err := writeData(w, edit.note); err != nil {
+					return err
+				}
+			}
+			continue
+
+		}
+
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// nullOID removes a note when it is given to git fast-import as the note content
+const nullOID = "0000000000000000000000000000000000000000"
+
+// rewriteNote rewrites a change to a notes ref. Notes on commits are attached to the
+// rewritten commits, notes on other objects are kept where they are.
+func (hr *historyRewriter) rewriteNote(w io.Writer, fields []string) error {
+	rawPath := fields[len(fields)-1]
+	annotated := strings.ReplaceAll(unquoteGitPath(rawPath), "/", "") // notes may be fanned out into directories
+	mark, isCommit := hr.marks[annotated]
+
+	if fields[0] == "D" {
+		if isCommit {
+			_, err := fmt.Fprintf(w, "N %s %s\n", nullOID, mark)
+			return err
+		}
+		_, err := fmt.Fprintf(w, "D %s\n", rawPath)
+		return err
+	}
+
+	if len(fields) != 4 || strings.HasPrefix(fields[2], ":") || fields[2] == "inline" {
+		return fmt.Errorf("error parsing git fast-export: unexpected note %q", strings.Join(fields, " "))
+	}
+	content, err := hr.blobs(fields[2])
+	if err != nil {
+		return err
+	}
+	if content, err = hr.maskMessage("note", annotated, content); err != nil {
+		return err
+	}
+	if isCommit {
+		_, err = fmt.Fprintf(w, "N inline %s\n", mark)
+	} else {
+		_, err = fmt.Fprintf(w, "M %s inline %s\n", fields[1], rawPath)
+	}
+	if err != nil {
+		return err
+	}
+	return writeData(w, content)
+}
+
+// RewriteHistory rewrites every commit of the source repository into a new
+// repository at the target directory, masking every version of the files with
+// findings and the secrets in commit messages, tag annotations and notes. Authors,
+// committers, dates, merges, branches and tags are kept. The map from original to rewritten commit IDs is written to commitMapPath.
+func (m *Masker) RewriteHistory(ctx context.Context, commitMapPath string) error {
+	if _, err := runGit(ctx, m.sourceDir, "rev-parse", "--git-dir"); err != nil {
+		return fmt.Errorf("%s is not a git repository: %v", m.sourceDir, err)
+	}
+	if entries, err := os.ReadDir(m.targetDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("target directory %s is not empty, history mode writes a new repository", m.targetDir)
+	}
+	if _, err := runGit(ctx, ".", "init", "--quiet", m.targetDir); err != nil {
+		return err
+	}
+	gitDir, err := runGit(ctx, m.targetDir, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return err
+	}
+	marksPath := filepath.Join(gitDir, "credential-masker-marks")
+	defer os.Remove(marksPath)
+
+	blobs, err := newBlobReader(ctx, m.sourceDir)
+	if err != nil {
+		return err
+	}
+	defer blobs.Close()
+
+	imp := exec.CommandContext(ctx, "git", "-C", m.targetDir, "fast-import", "--quiet", "--export-marks="+marksPath)
+	var importErr bytes.Buffer
+	imp.Stderr = &importErr
+	imported, err := imp.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := imp.Start(); err != nil {
+		return fmt.Errorf("error starting git fast-import: %v", err)
+	}
+
+	// Notes are exported last, so the commits they annotate have been rewritten and
+	// the notes can be moved to them
+	exportMarksPath := filepath.Join(gitDir, "credential-masker-export-marks")
+	defer os.Remove(exportMarksPath)
+	hr := &historyRewriter{m: m, blobs: blobs.read, masked: make(map[string]memberEdit), clean: make(map[string]bool), secrets: m.messageSecrets(), oids: make(map[string]string), marks: make(map[string]string)}
+	w := bufio.NewWriter(imported)
+	rewriteErr := errors.Join(
+		hr.export(ctx, w, "--export-marks="+exportMarksPath, "--exclude=refs/notes/*", "--all"),
+		hr.export(ctx, w, "--import-marks="+exportMarksPath, "--glob=refs/notes/*"),
+	)
+	if err := w.Flush(); err != nil && rewriteErr == nil {
+		rewriteErr = err
+	}
+	imported.Close()
+	if err := imp.Wait(); err != nil {
+		return fmt.Errorf("error running git fast-import: %v: %s", err, strings.TrimSpace(importErr.String()))
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err := hr.writeCommitMap(marksPath, commitMapPath); err != nil {
+		return err
+	}
+	if err := checkoutHead(ctx, m.sourceDir, m.targetDir); err != nil {
+		return err
+	}
+	m.logger.Success("Rewrote %d commit(s), masking %d file version(s) and %d message(s)", hr.stats.commits, hr.stats.masked, hr.stats.messages)
+	return rewriteErr
+}
+
+// export runs git fast-export on the source repository with the given arguments
+// and writes its rewritten stream to w. Blobs are exported by ID and written
+// inline, so the original versions of masked files never reach the new repository.
+func (hr *historyRewriter) export(ctx context.Context, w io.Writer, args ...string) error {
+	args = append([]string{"-C", hr.m.sourceDir, "fast-export", "--no-data", "--show-original-ids", "--reencode=yes", "--signed-tags=strip"}, args...)
+	export := exec.CommandContext(ctx, "git", args...)
+	var exportErr bytes.Buffer
+	export.Stderr = &exportErr
+	exported, err := export.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := export.Start(); err != nil {
+		return fmt.Errorf("error starting git fast-export: %v", err)
+	}
+
+	rewriteErr := hr.rewrite(ctx, bufio.NewReader(exported), w)
+	io.Copy(io.Discard, exported) // drain the stream if the rewrite stopped early
+	if err := export.Wait(); err != nil {
+		return fmt.Errorf("error running git fast-export: %v: %s", err, strings.TrimSpace(exportErr.String()))
+	}
+	return rewriteErr
+}
+
+// writeCommitMap writes the original and rewritten ID of every commit, one pair per
+// line, from the marks exported by git fast-import
+func (hr *historyRewriter) writeCommitMap(marksPath, commitMapPath string) error {
+	raw, err := os.ReadFile(marksPath)
+	if err != nil {
+		return fmt.Errorf("error reading marks: %v", err)
+	}
+	rewritten := make(map[string]string)
+	for _, line := range strings.Split(string(raw), "\n") {
+		if mark, oid, ok := strings.Cut(line, " "); ok {
+			rewritten[mark] = oid
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("old new\n")
+	for _, mark := range hr.commits {
+		if hr.oids[mark] != "" && rewritten[mark] != "" {
+			fmt.Fprintf(&b, "%s %s\n", hr.oids[mark], rewritten[mark])
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(commitMapPath), 0700); err != nil {
+		return fmt.Errorf("error creating directory of commit map: %v", err)
+	}
+	if err := os.WriteFile(commitMapPath, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("error writing commit map: %v", err)
+	}
+	return nil
+}
+
+// checkoutHead points the head of the target repository at the branch checked out
+// in the source repository and checks it out
+func checkoutHead(ctx context.Context, sourceDir, targetDir string) error {
+	head, err := runGit(ctx, sourceDir, "symbolic-ref", "--quiet", "HEAD")
+	if err != nil {
+		return nil // detached or unborn, the target keeps its default branch
+	}
+	if _, err := runGit(ctx, targetDir, "symbolic-ref", "HEAD", head); err != nil {
+		return err
+	}
+	if _, err := runGit(ctx, targetDir, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		return nil // the branch has no commits
+	}
+	_, err = runGit(ctx, targetDir, "reset", "--quiet", "--hard")
+	return err
+}
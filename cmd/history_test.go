@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitTest runs git in dir with a fixed identity and date, failing the test on errors
+func gitTest(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Alice", "GIT_AUTHOR_EMAIL=alice@example.com", "GIT_AUTHOR_DATE=2024-01-02T03:04:05Z",
+		"GIT_COMMITTER_NAME=Bob", "GIT_COMMITTER_EMAIL=bob@example.com", "GIT_COMMITTER_DATE=2024-01-02T03:04:05Z",
+		"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestMasker_RewriteHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	sourceDir := filepath.Join(t.TempDir(), "source")
+	targetDir := filepath.Join(t.TempDir(), "target")
+	gitTest(t, ".", "init", "--quiet", "--initial-branch=main", sourceDir)
+	commit := func(message string, files map[string]string) string {
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(sourceDir, name), []byte(content), 0600); err != nil {
+				t.Fatalf("Failed to write %s: %v", name, err)
+			}
+		}
+		gitTest(t, sourceDir, "add", "--all")
+		gitTest(t, sourceDir, "commit", "--quiet", "--message", message)
+		return gitTest(t, sourceDir, "rev-parse", "HEAD")
+	}
+
+	added := commit("Add config", map[string]string{"config.txt": "password=s3cr3t\n", "README.md": "# Project\n"})
+	commit("Add user", map[string]string{"config.txt": "password=s3cr3t\nuser=admin\n"})
+	gitTest(t, sourceDir, "tag", "--annotate", "--message", "First release", "v1.0.0")
+	gitTest(t, sourceDir, "mv", "config.txt", "settings.txt")
+	commit("Rename config", nil)
+
+	findings := []finding{{RuleID: "password", File: "config.txt", StartLine: 1, EndLine: 1, Secret: "s3cr3t", Commit: added, ID: "test-id"}}
+	masker := NewMasker(sourceDir, targetDir, findings, MaskerOptions{PlaceholderMask: "<%[2]s>"}, Default())
+	commitMap := filepath.Join(t.TempDir(), "commit-map")
+	if err := masker.RewriteHistory(context.Background(), commitMap); err != nil {
+		t.Fatalf("RewriteHistory failed: %v", err)
+	}
+
+	// No version of any file keeps the secret, renamed copies included
+	history := gitTest(t, targetDir, "log", "--all", "--patch", "--format=%H")
+	if strings.Contains(history, "s3cr3t") {
+		t.Errorf("Expected the secret to be masked in every commit, got\n%s", history)
+	}
+	if !strings.Contains(history, "+password=<password>") {
+		t.Errorf("Expected the placeholder in the history, got\n%s", history)
+	}
+	content, err := os.ReadFile(filepath.Join(targetDir, "settings.txt"))
+	if err != nil || string(content) != "password=<password>\nuser=admin\n" {
+		t.Errorf("Expected the checked out file to be masked, got %q (%v)", content, err)
+	}
+
+	// Metadata, topology and tags are kept
+	format := "--format=%an <%ae> %ad | %cn <%ce> %cd | %s | %d"
+	if got, want := gitTest(t, targetDir, "log", "--all", format), gitTest(t, sourceDir, "log", "--all", format); got != want {
+		t.Errorf("Expected the same commit metadata, got\n%s\nwant\n%s", got, want)
+	}
+	if got := gitTest(t, targetDir, "tag", "--list", "--format=%(refname:short) %(contents:subject)"); got != "v1.0.0 First release" {
+		t.Errorf("Expected the annotated tag to be kept, got %q", got)
+	}
+
+	// The commit map pairs every original commit with its rewrite
+	raw, err := os.ReadFile(commitMap)
+	if err != nil {
+		t.Fatalf("Failed to read commit map: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	original := strings.Fields(gitTest(t, sourceDir, "rev-list", "--all"))
+	if len(lines) != len(original)+1 || lines[0] != "old new" {
+		t.Fatalf("Expected a header and %d commits in the commit map, got\n%s", len(original), raw)
+	}
+	for _, line := range lines[1:] {
+		old, rewritten, _ := strings.Cut(line, " ")
+		if gitTest(t, sourceDir, "log", "-1", "--format=%s", old) != gitTest(t, targetDir, "log", "-1", "--format=%s", rewritten) {
+			t.Errorf("Expected %s to map to a rewrite of the same commit, got %s", old, rewritten)
+		}
+	}
+}
+
+func TestMasker_RewriteHistory_Renamed(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	sourceDir := filepath.Join(t.TempDir(), "source")
+	targetDir := filepath.Join(t.TempDir(), "target")
+	gitTest(t, ".", "init", "--quiet", "--initial-branch=main", sourceDir)
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	// The secret is reported at the path the file was renamed to, so the blob is
+	// first seen at a path without findings, along with a copy of the secret
+	write("old.conf", "password=s3cr3t\n")
+	write("backup.conf", "# backup\npassword=s3cr3t\n")
+	gitTest(t, sourceDir, "add", "--all")
+	gitTest(t, sourceDir, "commit", "--quiet", "--message", "Add config")
+	gitTest(t, sourceDir, "mv", "old.conf", "app.conf")
+	gitTest(t, sourceDir, "commit", "--quiet", "--message", "Rename config")
+	renamed := gitTest(t, sourceDir, "rev-parse", "HEAD")
+
+	findings := []finding{{RuleID: "password", File: "app.conf", StartLine: 1, EndLine: 1, Secret: "s3cr3t", Commit: renamed}}
+	masker := NewMasker(sourceDir, targetDir, findings, MaskerOptions{PlaceholderMask: "<%[2]s>"}, Default())
+	if err := masker.RewriteHistory(context.Background(), filepath.Join(t.TempDir(), "commit-map")); err != nil {
+		t.Fatalf("RewriteHistory failed: %v", err)
+	}
+
+	history := gitTest(t, targetDir, "log", "--all", "--patch", "--format=%H")
+	if strings.Contains(history, "s3cr3t") {
+		t.Errorf("Expected the secret to be masked before the rename and in the copy, got\n%s", history)
+	}
+	content, err := os.ReadFile(filepath.Join(targetDir, "backup.conf"))
+	if err != nil || string(content) != "# backup\npassword=<password>\n" {
+		t.Errorf("Expected the copy to be masked, got %q (%v)", content, err)
+	}
+}
+
+func TestMasker_RewriteHistory_Messages(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	sourceDir := filepath.Join(t.TempDir(), "source")
+	targetDir := filepath.Join(t.TempDir(), "target")
+	gitTest(t, ".", "init", "--quiet", "--initial-branch=main", sourceDir)
+	if err := os.WriteFile(filepath.Join(sourceDir, "config.txt"), []byte("password=s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("Failed to write config.txt: %v", err)
+	}
+	gitTest(t, sourceDir, "add", "--all")
+	gitTest(t, sourceDir, "commit", "--quiet", "--message", "Add config\n\nLogin with token tok3n-abc and s3cr3t")
+	commit := gitTest(t, sourceDir, "rev-parse", "HEAD")
+	gitTest(t, sourceDir, "tag", "--annotate", "--message", "Release built with tok3n-abc", "v1.0.0")
+	gitTest(t, sourceDir, "notes", "add", "--message", "Deployed with s3cr3t", "HEAD")
+
+	findings := []finding{
+		{RuleID: "password", File: "config.txt", StartLine: 1, EndLine: 1, Secret: "s3cr3t", Commit: commit},
+		{RuleID: "token", StartLine: 3, EndLine: 3, Secret: "tok3n-abc", Commit: commit},
+	}
+	masker := NewMasker(sourceDir, targetDir, findings, MaskerOptions{PlaceholderMask: "<%[1]s-%[2]s>"}, Default())
+	if err := masker.RewriteHistory(context.Background(), filepath.Join(t.TempDir(), "commit-map")); err != nil {
+		t.Fatalf("RewriteHistory failed: %v", err)
+	}
+
+	// Secrets of both message and file findings are masked, named after the kind of message
+	if got, want := gitTest(t, targetDir, "log", "-1", "--format=%B", "main"), "Add config\n\nLogin with token <commit-token> and <commit-password>"; got != want {
+		t.Errorf("Expected commit message %q, got %q", want, got)
+	}
+	if got, want := gitTest(t, targetDir, "tag", "--list", "--format=%(contents:subject)"), "Release built with <tag-token>"; got != want {
+		t.Errorf("Expected tag message %q, got %q", want, got)
+	}
+	if got, want := gitTest(t, targetDir, "notes", "show", "main"), "Deployed with <note-password>"; got != want {
+		t.Errorf("Expected note %q, got %q", want, got)
+	}
+
+	// Findings in commit messages are reported by commit
+	results := masker.results()
+	if reported := results["commit "+commit]; len(reported) != 1 || reported[0].RuleID != "token" {
+		t.Errorf("Expected the message finding to be reported under its commit, got %+v", results)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// defaultIDNamespace is the UUIDv5 namespace used if none is configured
+var defaultIDNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/yungjakey/credential-masker"))
+
+// IDMode controls how placeholder IDs are assigned to findings
+type IDMode int
+
+const (
+	// IDRandom assigns a random UUIDv4 on every run
+	IDRandom IDMode = iota
+	// IDHMAC derives the ID from a keyed HMAC-SHA256, formatted as a UUIDv8
+	IDHMAC
+	// IDUUIDv5 derives the ID as a UUIDv5 in a configurable namespace
+	IDUUIDv5
+)
+
+// String returns the string representation of the ID mode
+func (im IDMode) String() string {
+	switch im {
+	case IDRandom:
+		return "random"
+	case IDHMAC:
+		return "hmac"
+	case IDUUIDv5:
+		return "uuidv5"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseIDMode parses a string into an IDMode
+func ParseIDMode(mode string) (IDMode, error) {
+	switch strings.ToLower(mode) {
+	case "random":
+		return IDRandom, nil
+	case "hmac":
+		return IDHMAC, nil
+	case "uuidv5":
+		return IDUUIDv5, nil
+	default:
+		return IDRandom, fmt.Errorf("unknown ID mode: %s", mode)
+	}
+}
+
+// IDScope controls which findings share a deterministic ID
+type IDScope int
+
+const (
+	// ScopeLocation gives the same secret in the same place the same ID
+	ScopeLocation IDScope = iota
+	// ScopeSecret gives the same secret the same ID wherever it is found
+	ScopeSecret
+)
+
+// String returns the string representation of the ID scope
+func (is IDScope) String() string {
+	switch is {
+	case ScopeLocation:
+		return "location"
+	case ScopeSecret:
+		return "secret"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseIDScope parses a string into an IDScope
+func ParseIDScope(scope string) (IDScope, error) {
+	switch strings.ToLower(scope) {
+	case "location":
+		return ScopeLocation, nil
+	case "secret":
+		return ScopeSecret, nil
+	default:
+		return ScopeLocation, fmt.Errorf("unknown ID scope: %s", scope)
+	}
+}
+
+// idGenerator assigns placeholder IDs to findings
+type idGenerator struct {
+	mode      IDMode
+	scope     IDScope
+	key       []byte
+	namespace uuid.UUID
+}
+
+// id returns the ID of a finding in the file at relPath, relative to the repository
+func (g idGenerator) id(f finding, relPath string) string {
+	if g.mode == IDRandom {
+		return uuid.New().String()
+	}
+
+	secret := f.Secret
+	if secret == "" {
+		secret = f.HashedSecret
+	}
+
+	// Fields are length-prefixed so their boundaries cannot be shifted
+	material := strconv.Itoa(len(secret)) + ":" + secret
+	if g.scope == ScopeLocation {
+		location := f.Fingerprint
+		if location == "" {
+			location = fmt.Sprintf("%s:%s:%d", relPath, f.RuleID, f.StartLine)
+		}
+		material = strconv.Itoa(len(location)) + ":" + location + material
+	}
+
+	if g.mode == IDUUIDv5 {
+		namespace := g.namespace
+		if namespace == uuid.Nil {
+			namespace = defaultIDNamespace
+		}
+		return uuid.NewSHA1(namespace, []byte(material)).String()
+	}
+
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write([]byte(material))
+	var id uuid.UUID
+	copy(id[:], mac.Sum(nil))
+	id[6] = (id[6] & 0x0f) | 0x80 // version 8, custom
+	id[8] = (id[8] & 0x3f) | 0x80 // RFC 9562 variant
+	return id.String()
+}
+
+// hash returns the short hash of a secret for the Hash placeholder field. It is an
+// HMAC-SHA256 with the ID key if one is set. Without a key it is an unkeyed SHA-256,
+// which anyone holding the masked tree can test guesses of the secret against.
+func (g idGenerator) hash(secret string) string {
+	if len(g.key) == 0 {
+		sum := sha256.Sum256([]byte(secret))
+		return hex.EncodeToString(sum[:])[:8]
+	}
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))[:8]
+}
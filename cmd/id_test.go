@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIDGenerator_Deterministic(t *testing.T) {
+	first := finding{RuleID: "password", File: "a/config.yaml", StartLine: 3, Secret: "hunter2"}
+	moved := finding{RuleID: "password", File: "b/config.yaml", StartLine: 9, Secret: "hunter2"}
+	other := finding{RuleID: "password", File: "a/config.yaml", StartLine: 3, Secret: "letmein"}
+
+	tests := []struct {
+		name      string
+		gen       idGenerator
+		shareMove bool
+	}{
+		{name: "hmac location", gen: idGenerator{mode: IDHMAC, key: []byte("key")}},
+		{name: "hmac secret", gen: idGenerator{mode: IDHMAC, scope: ScopeSecret, key: []byte("key")}, shareMove: true},
+		{name: "uuidv5 location", gen: idGenerator{mode: IDUUIDv5, namespace: defaultIDNamespace}},
+		{name: "uuidv5 secret", gen: idGenerator{mode: IDUUIDv5, scope: ScopeSecret}, shareMove: true},
+	}
+
+	for _, tt := range tests {
+		id := tt.gen.id(first, "a/config.yaml")
+		if again := tt.gen.id(first, "a/config.yaml"); again != id {
+			t.Errorf("%s: expected the same ID on every run, but got %s and %s", tt.name, id, again)
+		}
+		if moved := tt.gen.id(moved, "b/config.yaml"); (moved == id) != tt.shareMove {
+			t.Errorf("%s: expected sharing across files to be %v, but got %s and %s", tt.name, tt.shareMove, id, moved)
+		}
+		if otherID := tt.gen.id(other, "a/config.yaml"); otherID == id {
+			t.Errorf("%s: expected different secrets to get different IDs", tt.name)
+		}
+	}
+
+	// The key changes every HMAC ID
+	keyed := idGenerator{mode: IDHMAC, key: []byte("other key")}
+	if keyed.id(first, "a/config.yaml") == (idGenerator{mode: IDHMAC, key: []byte("key")}).id(first, "a/config.yaml") {
+		t.Errorf("Expected HMAC IDs to depend on the key")
+	}
+}
+
+func TestIDGenerator_Hash(t *testing.T) {
+	// Without a key the hash is the unkeyed SHA-256 of the secret
+	if got := (idGenerator{}).hash("hunter2"); got != "f52fbd32" {
+		t.Errorf("Expected the unkeyed hash f52fbd32, but got %s", got)
+	}
+
+	keyed := idGenerator{mode: IDRandom, key: []byte("key")}
+	hash := keyed.hash("hunter2")
+	if len(hash) != 8 || hash == "f52fbd32" {
+		t.Errorf("Expected 8 hex characters of an HMAC, but got %s", hash)
+	}
+	if other := (idGenerator{key: []byte("other key")}).hash("hunter2"); other == hash {
+		t.Errorf("Expected the hash to depend on the key")
+	}
+	if other := keyed.hash("letmein"); other == hash {
+		t.Errorf("Expected different secrets to get different hashes")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hexDigestPattern matches SHA-256 digests in manifests, configs and blob paths
+var hexDigestPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// digestChange is the new digest and size of a changed blob
+type digestChange struct {
+	hex  string
+	size int64 // -1 for diff IDs, which are not referenced with a size
+}
+
+// isImage reports whether the tar entries are a Docker or OCI image, as written by
+// docker save or an OCI image layout
+func isImage(entries []tarEntry) bool {
+	for _, e := range entries {
+		if name := tarMemberName(e.header); name == "manifest.json" || name == "oci-layout" {
+			return true
+		}
+	}
+	return false
+}
+
+// updateImageDigests recomputes the digests of the changed members of an image and
+// updates them wherever they are referenced: layer descriptors and diff IDs,
+// manifests, the index and the names of the blobs. Manifests and configs change in
+// turn, so references are updated until nothing changes anymore.
+func updateImageDigests(entries []tarEntry, changed map[string][]byte) {
+	mapping := make(map[string]digestChange)
+	for _, e := range entries {
+		original, ok := changed[tarMemberName(e.header)]
+		if !ok {
+			continue
+		}
+		oldHex, newHex := sha256Hex(original), sha256Hex(e.content)
+		mapping[oldHex] = digestChange{hex: newHex, size: int64(len(e.content))}
+
+		// Configs list layers by the digest of their uncompressed content
+		oldDiffID, oldErr := diffID(original)
+		newDiffID, newErr := diffID(e.content)
+		if oldErr == nil && newErr == nil && oldDiffID != oldHex {
+			mapping[oldDiffID] = digestChange{hex: newDiffID, size: -1}
+		}
+	}
+
+	for updated := true; updated; {
+		updated = false
+		for i, e := range entries {
+			if e.header.Typeflag != tar.TypeReg || !looksLikeJSON(e.content) {
+				continue
+			}
+			content, ok, err := rewriteDigests(e.content, mapping)
+			if err != nil || !ok {
+				continue // not JSON after all, or nothing to update
+			}
+			mapping[sha256Hex(e.content)] = digestChange{hex: sha256Hex(content), size: int64(len(content))}
+			entries[i] = tarEntry{header: withSize(e.header, len(content)), content: content}
+			updated = true
+		}
+	}
+
+	// Blobs are named after their digest
+	for i, e := range entries {
+		name := hexDigestPattern.ReplaceAllStringFunc(e.header.Name, func(h string) string {
+			return resolveDigest(h, mapping)
+		})
+		if name != e.header.Name {
+			hdr := *entries[i].header
+			hdr.Name = name
+			entries[i].header = &hdr
+		}
+	}
+}
+
+// resolveDigest follows the changes of a digest to the final one
+func resolveDigest(h string, mapping map[string]digestChange) string {
+	for seen := 0; seen <= len(mapping); seen++ {
+		c, ok := mapping[h]
+		if !ok {
+			break
+		}
+		h = c.hex
+	}
+	return h
+}
+
+// rewriteDigests replaces the changed digests in a JSON document, along with the
+// size of descriptors pointing to them. It reports whether anything changed.
+func rewriteDigests(content []byte, mapping map[string]digestChange) ([]byte, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	replace := func(s string) string {
+		return hexDigestPattern.ReplaceAllStringFunc(s, func(h string) string {
+			if c, ok := mapping[h]; ok {
+				changed = true
+				return c.hex
+			}
+			return h
+		})
+	}
+
+	var walk func(v any) any
+	walk = func(v any) any {
+		switch v := v.(type) {
+		case map[string]any:
+			// Descriptors carry the size of the blob next to its digest
+			if digest, ok := v["digest"].(string); ok {
+				if c, ok := mapping[strings.TrimPrefix(digest, "sha256:")]; ok && c.size >= 0 {
+					if _, hasSize := v["size"]; hasSize {
+						v["size"] = json.Number(strconv.FormatInt(c.size, 10))
+					}
+				}
+			}
+			for k, child := range v {
+				v[k] = walk(child)
+			}
+			return v
+		case []any:
+			for i, child := range v {
+				v[i] = walk(child)
+			}
+			return v
+		case string:
+			return replace(v)
+		default:
+			return v
+		}
+	}
+	doc = walk(doc)
+	if !changed {
+		return nil, false, nil
+	}
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, false, err
+	}
+	result := out.Bytes()
+	if !bytes.HasSuffix(content, []byte("\n")) {
+		result = bytes.TrimSuffix(result, []byte("\n"))
+	}
+	return result, true, nil
+}
+
+// diffID returns the digest of the uncompressed content of a layer
+func diffID(layer []byte) (string, error) {
+	if !bytes.HasPrefix(layer, []byte{0x1f, 0x8b}) {
+		return sha256Hex(layer), nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(layer))
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, zr); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sha256Hex returns the hex encoded SHA-256 of the content
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// looksLikeJSON reports whether the content starts like a JSON object or array
+func looksLikeJSON(content []byte) bool {
+	trimmed := bytes.TrimLeft(content, " \t\r\n")
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+}
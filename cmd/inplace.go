@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	cp "github.com/otiai10/copy"
+)
+
+// errNotGitTree is returned when a directory masked in place is not in a git work
+// tree, so there is nothing to check and git cannot revert the masking
+var errNotGitTree = errors.New("not in a git work tree")
+
+// checkCleanTree returns an error if the directory has uncommitted changes or
+// untracked files, which masking in place would mix with its own changes
+func checkCleanTree(ctx context.Context, dir string) error {
+	if _, err := runGit(ctx, dir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		return fmt.Errorf("%s is %w", dir, errNotGitTree)
+	}
+	status, err := runGit(ctx, dir, "status", "--porcelain", "--untracked-files=normal", "--", ".")
+	if err != nil {
+		return err
+	}
+	if status == "" {
+		return nil
+	}
+
+	changes := strings.Split(status, "\n")
+	examples := changes[:min(len(changes), 3)]
+	for i, c := range examples {
+		examples[i] = strings.TrimSpace(c[min(len(c), 2):])
+	}
+	return fmt.Errorf("%s has %d uncommitted change(s), e.g. %s", dir, len(changes), strings.Join(examples, ", "))
+}
+
+// backupFiles copies every file with findings into a new directory below dir,
+// named after the time of the run, keeping their paths relative to the target. It
+// returns the directory of the backup and the number of files copied.
+func (m *Masker) backupFiles(dir string) (string, int, error) {
+	backup := filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z"))
+	if _, err := os.Stat(backup); err == nil {
+		return "", 0, fmt.Errorf("backup directory %s already exists", backup)
+	}
+
+	count := 0
+	for _, path := range slices.Sorted(maps.Keys(m.findings)) {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			continue // reported when the file is masked
+		}
+		dest := filepath.Join(backup, relativeTo(m.targetDir, path))
+		if err := cp.Copy(path, dest, cp.Options{PreserveTimes: true}); err != nil {
+			return "", count, fmt.Errorf("error backing up %s: %v", path, err)
+		}
+		count++
+	}
+	return backup, count, nil
+}
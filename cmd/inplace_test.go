@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckCleanTree(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	if err := checkCleanTree(context.Background(), t.TempDir()); !errors.Is(err, errNotGitTree) {
+		t.Errorf("Expected a directory outside of git to be reported, got %v", err)
+	}
+
+	dir := t.TempDir()
+	gitTest(t, ".", "init", "--quiet", dir)
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	write("app.conf", "password=s3cr3t\n")
+	write(".gitignore", "*.log\n")
+	gitTest(t, dir, "add", "--all")
+	gitTest(t, dir, "commit", "--quiet", "--message", "Add config")
+
+	write("debug.log", "ignored\n")
+	if err := checkCleanTree(context.Background(), dir); err != nil {
+		t.Errorf("Expected a clean tree with ignored files to pass, got %v", err)
+	}
+
+	write("app.conf", "password=changed\n")
+	write("notes.txt", "untracked\n")
+	err := checkCleanTree(context.Background(), dir)
+	if err == nil || !strings.Contains(err.Error(), "2 uncommitted change(s)") || !strings.Contains(err.Error(), "app.conf") {
+		t.Errorf("Expected the modified and untracked files to be reported, got %v", err)
+	}
+}
+
+func TestMasker_BackupFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "config"), 0700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	content := "password=s3cr3t\n"
+	if err := os.WriteFile(filepath.Join(dir, "config", "app.conf"), []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write app.conf: %v", err)
+	}
+	findings := []finding{
+		{RuleID: "password", File: "config/app.conf", StartLine: 1, EndLine: 1, Secret: "s3cr3t"},
+		{RuleID: "password", File: "missing.conf", StartLine: 1, EndLine: 1, Secret: "s3cr3t"},
+	}
+
+	masker := NewMasker(dir, dir, findings, MaskerOptions{PlaceholderMask: "<%[2]s>"}, Default())
+	backup, count, err := masker.backupFiles(filepath.Join(t.TempDir(), "backups"))
+	if err != nil {
+		t.Fatalf("backupFiles failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 file to be backed up, got %d", count)
+	}
+	masker.Process()
+
+	backedUp, err := os.ReadFile(filepath.Join(backup, "config", "app.conf"))
+	if err != nil || string(backedUp) != content {
+		t.Errorf("Expected the original content in the backup, got %q (%v)", backedUp, err)
+	}
+	masked, err := os.ReadFile(filepath.Join(dir, "config", "app.conf"))
+	if err != nil || string(masked) != "password=<password>\n" {
+		t.Errorf("Expected the file to be masked in place, got %q (%v)", masked, err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/sha1" // #nosec G505 -- detect-secrets identifies secrets by SHA-1
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// MatchMode controls how the location of a secret is resolved inside a file
+type MatchMode int
+
+const (
+	// MatchGlobal replaces every occurrence of the secret anywhere in the file
+	MatchGlobal MatchMode = iota
+	// MatchPosition replaces only the span reported by the scanner
+	MatchPosition
+)
+
+// String returns the string representation of the match mode
+func (mm MatchMode) String() string {
+	switch mm {
+	case MatchGlobal:
+		return "global"
+	case MatchPosition:
+		return "position"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseMatchMode parses a string into a MatchMode
+func ParseMatchMode(mode string) (MatchMode, error) {
+	switch strings.ToLower(mode) {
+	case "global":
+		return MatchGlobal, nil
+	case "position":
+		return MatchPosition, nil
+	default:
+		return MatchGlobal, fmt.Errorf("unknown match mode: %s", mode)
+	}
+}
+
+// span is a half-open byte range [start, end) inside a text buffer
+type span struct {
+	start int
+	end   int
+}
+
+// replacement describes a span of a text buffer that is replaced by a placeholder
+type replacement struct {
+	span
+	text string
+}
+
+// lineIndex maps 1-based line numbers to the byte offset at which they start
+type lineIndex []int
+
+// newLineIndex builds the line index of the given text
+func newLineIndex(text string) lineIndex {
+	idx := lineIndex{0}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			idx = append(idx, i+1)
+		}
+	}
+	return idx
+}
+
+// lineStart returns the offset of the first byte of the given 1-based line
+func (li lineIndex) lineStart(line int) (int, bool) {
+	if line < 1 || line > len(li) {
+		return 0, false
+	}
+	return li[line-1], true
+}
+
+// lineEnd returns the offset just past the last byte of the given 1-based line, excluding the line feed
+func (li lineIndex) lineEnd(text string, line int) (int, bool) {
+	if line < 1 || line > len(li) {
+		return 0, false
+	}
+	if line == len(li) {
+		return len(text), true
+	}
+	return li[line] - 1, true
+}
+
+// position returns the 1-based line and column of the byte at the given offset
+func (li lineIndex) position(offset int) (int, int) {
+	line := sort.SearchInts(li, offset+1)
+	return line, offset - li[line-1] + 1
+}
+
+// findAll returns the spans of all non-overlapping occurrences of needle in text[from:to]
+func findAll(text, needle string, from, to int) []span {
+	var spans []span
+	if needle == "" {
+		return spans
+	}
+	for from < to {
+		i := strings.Index(text[from:to], needle)
+		if i < 0 {
+			break
+		}
+		start := from + i
+		spans = append(spans, span{start: start, end: start + len(needle)})
+		from = start + len(needle)
+	}
+	return spans
+}
+
+// locate returns the spans of text that hold the secret of the given finding
+func (m *Masker) locate(text string, lines lineIndex, path string, f finding) ([]span, error) {
+	mode := m.matchMode
+	if p := m.policyFor(path, f); p.MatchMode != "" {
+		mode, _ = ParseMatchMode(p.MatchMode) // validated when the config is loaded
+	}
+	if mode == MatchGlobal {
+		return findAll(text, f.Secret, 0, len(text)), nil
+	}
+
+	if f.StartLine <= 0 {
+		m.logger.Warning("Finding %s (%s) in %s has no line information, searching the whole file", f.ID, f.RuleID, path)
+		return findAll(text, f.Secret, 0, len(text)), nil
+	}
+
+	endLine := max(f.EndLine, f.StartLine)
+
+	// Try the exact span reported by the scanner first. Scanners usually report the
+	// span of the whole match, so the secret is searched within it.
+	if f.StartColumn > 0 && f.EndColumn > 0 {
+		lineStart, okStart := lines.lineStart(f.StartLine)
+		endLineStart, okEnd := lines.lineStart(endLine)
+		start := lineStart + f.StartColumn - 1
+		end := endLineStart + f.EndColumn
+		if okStart && okEnd && start < end && end <= len(text) {
+			if spans := findAll(text, f.Secret, start, end); len(spans) > 0 {
+				return spans, nil
+			}
+		}
+		m.logger.Warning("Finding %s (%s) in %s: bytes at %d:%d-%d:%d do not match the secret, searching lines %d-%d instead",
+			f.ID, f.RuleID, path, f.StartLine, f.StartColumn, endLine, f.EndColumn, f.StartLine, endLine)
+	}
+
+	// Fall back to a search scoped to the reported line range
+	return locateInLines(text, lines, path, f)
+}
+
+// locateInLines returns the spans of the secret within the line range reported by the finding
+func locateInLines(text string, lines lineIndex, path string, f finding) ([]span, error) {
+	from, to, err := lineRange(text, lines, path, f)
+	if err != nil {
+		return nil, err
+	}
+	spans := findAll(text, f.Secret, from, to)
+	if len(spans) == 0 {
+		return nil, fmt.Errorf("finding %s (%s): secret not found in lines %d-%d of %s", f.ID, f.RuleID, f.StartLine, max(f.EndLine, f.StartLine), path)
+	}
+	return spans, nil
+}
+
+// lineRange returns the byte range covered by the lines reported by the finding
+func lineRange(text string, lines lineIndex, path string, f finding) (int, int, error) {
+	endLine := max(f.EndLine, f.StartLine)
+	from, okStart := lines.lineStart(f.StartLine)
+	to, okEnd := lines.lineEnd(text, endLine)
+	if !okStart || !okEnd {
+		return 0, 0, fmt.Errorf("finding %s (%s): lines %d-%d are outside of %s (%d lines)", f.ID, f.RuleID, f.StartLine, endLine, path, len(lines))
+	}
+	return from, to, nil
+}
+
+// resolveHashedSecret finds the token on the reported lines whose SHA-1 equals the
+// hashed secret of the finding, the way detect-secrets hashes the values it reports
+func resolveHashedSecret(text string, lines lineIndex, path string, f finding) (string, error) {
+	from, to, err := lineRange(text, lines, path, f)
+	if err != nil {
+		return "", err
+	}
+	want := strings.ToLower(f.HashedSecret)
+
+	for _, candidate := range secretCandidates(text[from:to]) {
+		sum := sha1.Sum([]byte(candidate)) // #nosec G401 -- detect-secrets identifies secrets by SHA-1
+		if hex.EncodeToString(sum[:]) == want {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("finding %s (%s): no value in lines %d-%d of %s matches hashed secret %s", f.ID, f.RuleID, f.StartLine, max(f.EndLine, f.StartLine), path, f.HashedSecret)
+}
+
+// secretCandidates splits a line into the values a secret scanner may have reported:
+// quoted strings, assigned values and tokens between common delimiters
+func secretCandidates(line string) []string {
+	seen := make(map[string]bool)
+	var candidates []string
+	add := func(c string) {
+		c = strings.TrimSpace(c)
+		if c != "" && !seen[c] {
+			seen[c] = true
+			candidates = append(candidates, c)
+		}
+	}
+
+	// Contents of quoted strings
+	for _, quote := range []string{`"`, "'", "`"} {
+		parts := strings.Split(line, quote)
+		for i := 1; i < len(parts); i += 2 {
+			add(parts[i])
+		}
+	}
+
+	// Value of an assignment, with surrounding quotes and terminators removed
+	if i := strings.IndexAny(line, "=:"); i >= 0 {
+		add(strings.Trim(strings.TrimSpace(line[i+1:]), "\"'`,;"))
+	}
+
+	// Tokens, first split on whitespace only, then on common delimiters as well
+	for _, f := range strings.Fields(line) {
+		add(strings.Trim(f, "\"'`,;"))
+	}
+	for _, f := range strings.FieldsFunc(line, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("\"'`=:,;()[]{}<>@/", r)
+	}) {
+		add(f)
+	}
+
+	add(line)
+	return candidates
+}
+
+// applyReplacements replaces the given spans of text. Overlapping spans are resolved
+// in favour of the one that starts first, or the longer one if both start at the same offset.
+func applyReplacements(text string, replacements []replacement) string {
+	sort.SliceStable(replacements, func(i, j int) bool {
+		if replacements[i].start != replacements[j].start {
+			return replacements[i].start < replacements[j].start
+		}
+		return replacements[i].end > replacements[j].end
+	})
+
+	var b strings.Builder
+	b.Grow(len(text))
+	last := 0
+	for _, r := range replacements {
+		if r.start < last {
+			continue // overlaps a span that was already replaced
+		}
+		b.WriteString(text[last:r.start])
+		b.WriteString(r.text)
+		last = r.end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
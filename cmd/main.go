@@ -3,47 +3,25 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
-
-	cp "github.com/otiai10/copy"
 )
 
-// finding represents a credential or secret finding from gitleaks
-type finding struct {
-	RuleID      string  `json:"ruleID"`      // ID of the rule that triggered this finding
-	StartLine   int     `json:"startLine"`   // Line where the finding starts
-	EndLine     int     `json:"endLine"`     // Line where the finding ends
-	Match       string  `json:"match"`       // The matched text containing the secret
-	Secret      string  `json:"secret"`      // The actual secret value
-	File        string  `json:"file"`        // Path to the file containing the secret
-	Entropy     float64 `json:"entropy"`     // Entropy score of the secret
-	Fingerprint string  `json:"fingerprint"` // Unique identifier for this finding
-	ID          string  `json:"id"`          // Unique ID for this finding
-}
-
-// loadFindings loads and parses the findings JSON file
-func loadFindings(path string) ([]finding, error) {
-	raw, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("error reading findings JSON: %v", err)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "unmask" {
+		runUnmask(os.Args[2:])
+		return
 	}
-
-	var findings []finding
-	err = json.Unmarshal(raw, &findings)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing JSON: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
 	}
 
-	return findings, nil
-}
-
-func main() {
 	cfg, err := parseAndValidateFlags()
 	if err != nil {
 		fmt.Printf("❌ %v\n", err)
@@ -56,16 +34,26 @@ func main() {
 	}
 
 	log := cfg.logger
+	if cfg.configPath != "" {
+		log.Info("Using config file %s", cfg.configPath)
+	}
+	if cfg.idMode == IDUUIDv5 {
+		log.Warning("UUIDv5 IDs are unkeyed hashes of the secrets, prefer --id-mode hmac if the masked tree is shared")
+	}
+	if len(cfg.idKey) == 0 && cfg.hashesSecrets() {
+		log.Warning("{{.Hash}} placeholders are unkeyed hashes of the secrets, set --id-key or --id-key-file if the masked tree is shared")
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
 	done := make(chan struct{})
+	exitCode := 0
 
 	go func() {
 		defer close(done)
 
-		findings, err := loadFindings(cfg.findingsPath)
+		findings, err := loadReports(cfg.findingsPaths, cfg.findingsFormat, cfg.sourceDir, log)
 		if err != nil {
 			log.Fatal("%v", err)
 		}
@@ -79,50 +67,182 @@ func main() {
 			log.Debug("  - %s", t)
 		}
 
-		if _, err = os.Stat(cfg.targetDir); os.IsNotExist(err) {
+		opts := MaskerOptions{
+			PlaceholderMask: cfg.placeholderMask,
+			MatchMode:       cfg.matchMode,
+			Binary:          cfg.binary,
+			Policies:        cfg.policies,
+			IDMode:          cfg.idMode,
+			IDScope:         cfg.idScope,
+			IDKey:           cfg.idKey,
+			IDNamespace:     cfg.idNamespace,
+			StripOutputs:    cfg.stripOutputs,
+			PEMMode:         cfg.pemMode,
+			MaskEncoded:     cfg.maskEncoded,
+		}
+
+		ignoreFiles := []string{maskerIgnoreFile}
+		if cfg.gitignore {
+			ignoreFiles = append([]string{".gitignore"}, ignoreFiles...)
+		}
+		copied := false
+		var state *syncState
+		var plan syncPlan
+		if cfg.mode == ModeHistory {
+			// Reported lines only hold in the commit of each finding
+			opts.MatchMode, opts.Policies = MatchGlobal, opts.Policies.globalMatching()
+		} else if cfg.inPlace {
+			log.Info("Masking %s in place", cfg.sourceDir)
+			if err := checkCleanTree(ctx, cfg.sourceDir); errors.Is(err, errNotGitTree) {
+				log.Warning("%v, the masking cannot be reverted with git", err)
+			} else if err != nil && !cfg.force {
+				log.Fatal("Refusing to mask in place: %v. Commit or stash the changes, or use --force", err)
+			} else if err != nil {
+				log.Warning("Masking in place despite --force: %v", err)
+			}
+		} else if cfg.sync {
+			log.Info("Syncing %s to %s", cfg.sourceDir, cfg.targetDir)
+			if state, err = loadSyncState(cfg.syncStatePath); err != nil {
+				log.Fatal("%v", err)
+			}
+			if _, err := os.Stat(cfg.targetDir); err == nil && len(state.Files) == 0 {
+				log.Warning("No sync state in %s, copying every file and removing none", cfg.syncStatePath)
+			}
+			im := newIgnoreMatcher(cfg.sourceDir, ignoreFiles, cfg.excludes, cfg.includes)
+			digests := findingDigests(cfg.sourceDir, cfg.targetDir, findings)
+			if plan, err = syncTree(cfg.sourceDir, cfg.targetDir, im, cfg.gitMode, state, optionsDigest(opts), digests); err != nil {
+				log.Fatal("%v", err)
+			}
+			copied = true
+			opts.SkipFile = func(rel string) bool { return !plan.changed.contains(rel) }
+			log.Success("Synced %s to %s: %d changed, %d removed and %d unchanged file(s)",
+				cfg.sourceDir, cfg.targetDir, len(plan.changed), len(plan.removed), len(plan.unchanged))
+		} else if _, err = os.Stat(cfg.targetDir); os.IsNotExist(err) {
 			log.Info("Target directory does not exist, creating: %s", cfg.sourceDir)
-			if err = cp.Copy(cfg.sourceDir, cfg.targetDir); err != nil {
+			im := newIgnoreMatcher(cfg.sourceDir, ignoreFiles, cfg.excludes, cfg.includes)
+			excluded, err := copyTree(cfg.sourceDir, cfg.targetDir, im, cfg.gitMode)
+			if err != nil {
 				log.Fatal("%v", err)
 			}
-			log.Success("Copied %s to %s", cfg.sourceDir, cfg.targetDir)
+			copied = true
+			opts.SkipFile = excluded.contains
+			log.Success("Copied %s to %s, leaving out %d path(s)", cfg.sourceDir, cfg.targetDir, len(excluded))
 		} else {
 			log.Info("Target directory already exists: %s", cfg.targetDir)
 		}
 
-		masker := NewMasker(
-			cfg.sourceDir,
-			cfg.targetDir,
-			findings,
-			cfg.placeholderMask,
-			cfg.newLineSequence,
-			log,
-		)
+		masker := NewMasker(cfg.sourceDir, cfg.targetDir, findings, opts, log)
+		if cfg.backupDir != "" {
+			backup, count, err := masker.backupFiles(cfg.backupDir)
+			if err != nil {
+				log.Fatal("%v", err)
+			}
+			log.Success("Backed up %d file(s) to %s", count, backup)
+		}
 
-		fileFindings := masker.ProcessWithContext(ctx)
+		var fileFindings map[string][]finding
+		if cfg.mode == ModeHistory {
+			log.Info("Rewriting the history of %s into %s", cfg.sourceDir, cfg.targetDir)
+			if err := masker.RewriteHistory(ctx, cfg.commitMapPath); err != nil {
+				masker.fail(cfg.sourceDir, err)
+				log.Error("Error rewriting history: %v", err)
+			} else {
+				log.Success("Saved commit map to %s", cfg.commitMapPath)
+			}
+			fileFindings = masker.results()
+		} else {
+			fileFindings = masker.ProcessWithContext(ctx)
+		}
 
 		if ctx.Err() != nil {
 			log.Warning("Processing was interrupted: %v", ctx.Err())
 			return
 		}
 
-		log.Success("Processed %d findings", len(findings))
+		if errs := masker.Errors(); len(errs) > 0 {
+			log.Error("Failed to handle %d file(s)", len(errs))
+			exitCode = 1
+		} else {
+			log.Success("Processed %d findings", len(findings))
+		}
+
+		if state != nil {
+			if fileFindings, err = mergeSyncedResults(cfg.outputPath, cfg.targetDir, fileFindings, plan); err != nil {
+				log.Fatal("%v", err)
+			}
+		}
 
 		fileFindingsJSON, err := json.MarshalIndent(fileFindings, "", "  ")
 		if err != nil {
 			log.Fatal("Error marshalling file findings to JSON: %v", err)
 		}
 
-		outputPath := strings.NewReplacer("gitleaks", "gitleaks-grouped").Replace(cfg.findingsPath)
-		err = os.WriteFile(outputPath, fileFindingsJSON, 0600)
+		err = os.WriteFile(cfg.outputPath, fileFindingsJSON, 0600)
 		if err != nil {
 			log.Fatal("Error writing file findings to JSON: %v", err)
 		}
-		log.Success("Saved file findings to %s", outputPath)
+		log.Success("Saved file findings to %s", cfg.outputPath)
+
+		if cfg.vaultPath != "" {
+			entries := masker.VaultEntries()
+			if state != nil {
+				if entries, err = mergeSyncedVault(cfg.vaultPath, cfg.vaultKey, entries, plan); err != nil {
+					log.Fatal("%v", err)
+				}
+			}
+			if err = writeVault(cfg.vaultPath, cfg.vaultKey, entries); err != nil {
+				log.Fatal("%v", err)
+			}
+			log.Success("Saved %d placeholder(s) to vault %s", len(entries), cfg.vaultPath)
+		}
+
+		if cfg.verify {
+			var leaks []leak
+			if cfg.mode == ModeHistory {
+				leaks, err = verifyHistory(ctx, cfg.sourceDir, cfg.targetDir, findings, cfg.policies, cfg.binary, log)
+			} else {
+				leaks, err = verifyTree(cfg.sourceDir, cfg.targetDir, findings, cfg.policies, cfg.matchMode, cfg.binary, log)
+			}
+			if err != nil {
+				log.Fatal("%v", err)
+			}
+			if err := reportLeaks(leaks, log); err != nil {
+				log.Error("%v", err)
+				exitCode = 1
+				return
+			}
+			log.Success("Verified that no secret survived in %s", cfg.targetDir)
+		}
+
+		// The state is only saved once the files are masked and verified, files that
+		// failed are copied and masked again on the next sync
+		if state != nil && exitCode == 0 {
+			if err := state.record(cfg.targetDir, plan.changed, optionsDigest(opts)); err != nil {
+				log.Fatal("%v", err)
+			}
+			if err := state.save(cfg.syncStatePath); err != nil {
+				log.Fatal("%v", err)
+			}
+			log.Success("Saved sync state to %s", cfg.syncStatePath)
+		}
+
+		// The masked tree is only committed once it has been masked without errors
+		if copied && cfg.gitMode == GitFresh && exitCode == 0 {
+			commit, err := initFreshRepository(ctx, cfg.sourceDir, cfg.targetDir)
+			if err != nil {
+				log.Error("Error creating a fresh repository: %v", err)
+				exitCode = 1
+				return
+			}
+			log.Success("Committed the masked tree to a fresh repository in %s as %s", cfg.targetDir, commit)
+		}
 	}()
 
 	select {
 	case <-done:
-		// All good
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
 		return
 	case <-ctx.Done():
 		log.Warning("Shutdown signal received, waiting up to %v for graceful shutdown...", cfg.shutdownTimeout)
@@ -135,8 +255,100 @@ func main() {
 	select {
 	case <-done:
 		log.Info("Graceful shutdown completed in time")
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
 	case <-timer.C:
 		log.Error("Shutdown timeout exceeded. Forcing exit.")
 		os.Exit(1)
 	}
 }
+
+// loadReports loads every findings file and merges the reports
+func loadReports(paths []string, format FindingsFormat, sourceDir string, log *Logger) ([]finding, error) {
+	var reports [][]finding
+	for _, path := range paths {
+		report, err := loadFindings(path, format)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Loaded %d findings from %s", len(report), path)
+		unlocated := 0
+		for _, f := range report {
+			if f.Secret == "" && f.HashedSecret == "" && f.StartColumn == 0 {
+				unlocated++
+			}
+		}
+		if unlocated > 0 {
+			log.Warning("%d finding(s) in %s carry neither a secret nor columns and cannot be located", unlocated, path)
+		}
+		reports = append(reports, report)
+	}
+
+	findings := mergeFindings(sourceDir, reports...)
+	if len(reports) > 1 {
+		log.Info("Merged %d reports into %d unique findings", len(reports), len(findings))
+	}
+	return findings, nil
+}
+
+// runUnmask restores the secrets of a masked tree from its vault
+func runUnmask(args []string) {
+	cfg, err := parseUnmaskFlags(args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.showHelp {
+		return
+	}
+
+	log := cfg.logger
+	entries, err := readVault(cfg.vaultPath, cfg.vaultKey)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	log.Info("Loaded %d placeholder(s) from vault %s", len(entries), cfg.vaultPath)
+
+	restored, missing, err := unmaskTree(cfg.targetDir, entries, log)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	for _, e := range missing {
+		log.Warning("Placeholder %q of finding %s (%s) not found in %s", e.Placeholder, e.ID, e.RuleID, e.File)
+	}
+	log.Success("Restored %d placeholder(s) in %s", restored, cfg.targetDir)
+}
+
+// runVerify checks that no secret of the findings survived in a masked tree
+func runVerify(args []string) {
+	cfg, err := parseVerifyFlags(args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.showHelp {
+		return
+	}
+
+	log := cfg.logger
+	findings, err := loadReports(cfg.findingsPaths, cfg.findingsFormat, cfg.sourceDir, log)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	leaks, err := verifyTree(cfg.sourceDir, cfg.targetDir, findings, cfg.policies, cfg.matchMode, cfg.binary, log)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	if err := reportLeaks(leaks, log); err != nil {
+		log.Error("%v", err)
+		os.Exit(1)
+	}
+	log.Success("Verified that no secret survived in %s", cfg.targetDir)
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"unicode/utf8"
@@ -13,36 +15,109 @@ import (
 	"github.com/google/uuid"
 )
 
-const placeholderPrefix = "This file was deleted because it matched the pkcs12-file rule. Original file: %s"
-
 // Masker handles the masking of sensitive data in files
 type Masker struct {
 	logger          *Logger
 	findings        map[string][]finding // Map of file path to findings
+	messages        []finding            // Findings in commit messages, which have no file
 	sourceDir       string
 	targetDir       string
 	placeholderMask string
-	newLineSequence string
+	matchMode       MatchMode
+	binary          BinaryStrategy
+	policies        Policies
+	stripOutputs    bool
+	pemMode         PEMMode
+	maskEncoded     bool
+	ids             idGenerator
+	sequence        map[string]int // Sequence number of each finding's secret within its rule
+	templates       map[string]*placeholderTemplate
+	templatesMu     sync.Mutex
+	vault           map[string]vaultEntry // Placeholders written per file, for unmasking
+	vaultMu         sync.Mutex
+	derived         map[string][]finding // Encoded copies of secrets found per file
+	derivedMu       sync.Mutex
+	errs            []error // Files that could not be handled
+	errsMu          sync.Mutex
+}
+
+// MaskerOptions holds the settings that control how findings are masked
+type MaskerOptions struct {
+	PlaceholderMask string                // fmt template for placeholders
+	MatchMode       MatchMode             // How secrets are located in files
+	Binary          BinaryStrategy        // What happens to binary files with findings
+	Policies        Policies              // Per-rule and per-path overrides
+	IDMode          IDMode                // How placeholder IDs are assigned
+	IDScope         IDScope               // Which findings share a deterministic ID
+	IDKey           []byte                // Key for HMAC IDs
+	IDNamespace     uuid.UUID             // Namespace for UUIDv5 IDs
+	StripOutputs    bool                  // Remove the outputs of notebooks with findings
+	PEMMode         PEMMode               // Whether the armor lines of PEM blocks are kept
+	MaskEncoded     bool                  // Also mask base64, hex, URL and JSON encoded copies of secrets
+	SkipFile        func(rel string) bool // Reports files whose findings are skipped, e.g. files left out of the copy
 }
 
 // NewMasker creates a new Masker with the given logger
-func NewMasker(sourceDir string, targetDir string, findings []finding, placeholderMask string, newLineSequence string, logger *Logger) *Masker {
+func NewMasker(sourceDir string, targetDir string, findings []finding, opts MaskerOptions, logger *Logger) *Masker {
+	ids := idGenerator{mode: opts.IDMode, scope: opts.IDScope, key: opts.IDKey, namespace: opts.IDNamespace}
+
 	// Group findings by file
 	fileFindings := make(map[string][]finding)
+	var messages []finding
+	sequence := make(map[string]int)
+	seen := make(map[string]int)
+	counters := make(map[string]int)
 	for _, f := range findings {
-		// replace source and target directory
-		f.ID = uuid.New().String()
-		path := strings.NewReplacer(sourceDir, targetDir).Replace(f.File)
-		fileFindings[path] = append(fileFindings[path], f)
+		// replace source and target directory, findings inside archives are grouped by archive
+		archive, member := splitArchivePath(f.File)
+		path := targetPath(sourceDir, targetDir, archive)
+		rel := relativeTo(targetDir, path)
+		if member != "" {
+			rel += archiveSeparator + member
+		}
+		f.ID = ids.id(f, filepath.ToSlash(rel))
+		if opts.Policies.For(f.RuleID, rel).skips(f) {
+			logger.Debug("Skipping finding %s (%s) in %s by policy", f.ID, f.RuleID, path)
+			continue
+		}
+		if opts.SkipFile != nil && f.File != "" && opts.SkipFile(relativeTo(targetDir, path)) {
+			logger.Debug("Skipping finding %s (%s) in %s, the file is not masked in this run", f.ID, f.RuleID, path)
+			continue
+		}
+		if f.File == "" && f.Commit != "" {
+			// Secrets in commit messages have no file, they are masked in history mode
+			messages = append(messages, f)
+		} else {
+			fileFindings[path] = append(fileFindings[path], f)
+		}
+
+		// Number distinct secrets per rule in the order they were reported
+		key := f.RuleID + "\x00" + f.Secret + "\x00" + f.HashedSecret
+		if _, ok := seen[key]; !ok {
+			counters[f.RuleID]++
+			seen[key] = counters[f.RuleID]
+		}
+		sequence[f.ID] = seen[key]
 	}
 
 	return &Masker{
 		logger:          logger,
 		findings:        fileFindings,
+		messages:        messages,
 		sourceDir:       sourceDir,
 		targetDir:       targetDir,
-		placeholderMask: placeholderMask,
-		newLineSequence: newLineSequence,
+		placeholderMask: opts.PlaceholderMask,
+		matchMode:       opts.MatchMode,
+		binary:          opts.Binary,
+		policies:        opts.Policies,
+		stripOutputs:    opts.StripOutputs,
+		pemMode:         opts.PEMMode,
+		maskEncoded:     opts.MaskEncoded,
+		ids:             ids,
+		sequence:        sequence,
+		templates:       make(map[string]*placeholderTemplate),
+		vault:           make(map[string]vaultEntry),
+		derived:         make(map[string][]finding),
 	}
 }
 
@@ -53,6 +128,10 @@ func (m *Masker) Process() map[string][]finding {
 
 // ProcessWithContext processes all findings across files with context support
 func (m *Masker) ProcessWithContext(ctx context.Context) map[string][]finding {
+	if len(m.messages) > 0 {
+		m.logger.Warning("%d finding(s) in commit messages are only masked with --mode history", len(m.messages))
+	}
+
 	// Create a semaphore to limit concurrency
 	maxWorkers := runtime.NumCPU()
 	sem := make(chan struct{}, maxWorkers)
@@ -67,7 +146,7 @@ func (m *Masker) ProcessWithContext(ctx context.Context) map[string][]finding {
 		// Check if context is canceled
 		select {
 		case <-ctx.Done():
-			return m.findings
+			return m.results()
 		default:
 			// Continue processing
 		}
@@ -95,6 +174,7 @@ func (m *Masker) ProcessWithContext(ctx context.Context) map[string][]finding {
 			handler, err := m.ParseFileType(path, fileFinding)
 			if err != nil {
 				m.logger.Error("[%d/%d] Error parsing type of file: %v", i, N, err)
+				m.fail(path, err)
 				return
 			}
 			if handler == nil {
@@ -106,6 +186,7 @@ func (m *Masker) ProcessWithContext(ctx context.Context) map[string][]finding {
 			err = handler()
 			if err != nil {
 				m.logger.Error("[%d/%d] Error handling file: %v", i, N, err)
+				m.fail(path, err)
 				return
 			}
 
@@ -131,17 +212,65 @@ func (m *Masker) ProcessWithContext(ctx context.Context) map[string][]finding {
 		m.logger.Warning("Processing interrupted: %v", ctx.Err())
 	}
 
-	return m.findings
+	return m.results()
+}
+
+// results returns the findings of every file along with the findings derived from
+// them, and the findings in commit messages grouped by commit
+func (m *Masker) results() map[string][]finding {
+	m.derivedMu.Lock()
+	defer m.derivedMu.Unlock()
+
+	results := make(map[string][]finding, len(m.findings))
+	for path, findings := range m.findings {
+		results[path] = append(slices.Clone(findings), m.derived[path]...)
+	}
+	for _, f := range m.messages {
+		results["commit "+f.Commit] = append(results["commit "+f.Commit], f)
+	}
+	return results
+}
+
+// encodingFor returns the encoding configured for the path, or detects it from the content
+func (m *Masker) encodingFor(path string, buf []byte) textEncoding {
+	enc, _ := ParseTextEncoding(m.policies.ForPath(relativeTo(m.targetDir, path)).Encoding) // validated when the config is loaded
+	if enc == encAuto {
+		enc = detectEncoding(buf)
+		m.logger.Debug("Detected %s encoding.", enc)
+	}
+	return enc
+}
+
+// fail records that a file could not be handled
+func (m *Masker) fail(path string, err error) {
+	m.errsMu.Lock()
+	defer m.errsMu.Unlock()
+	m.errs = append(m.errs, fmt.Errorf("%s: %v", path, err))
+}
+
+// Errors returns the errors of the files that could not be handled
+func (m *Masker) Errors() []error {
+	m.errsMu.Lock()
+	defer m.errsMu.Unlock()
+	return append([]error(nil), m.errs...)
 }
 
 // ParseFileType determines the appropriate handler for a file based on its contents and findings
 func (m *Masker) ParseFileType(path string, fileFinding []finding) (func() error, error) {
-	// First see if any finding matches the pkcs12-file rule
+	// Findings inside archives are masked member by member
+	if isArchiveName(path) && hasMemberFindings(fileFinding) {
+		m.logger.Debug("Matched archive members.")
+		return func() error {
+			return m.HandleArchive(path, fileFinding...)
+		}, nil
+	}
+
+	// See if any finding matches the pkcs12-file rule
 	for _, f := range fileFinding {
 		if f.RuleID == "pkcs12-file" {
 			m.logger.Debug("Matched pkcs12-file rule.")
 			return func() error {
-				return m.HandleBinary(path)
+				return m.HandleBinary(path, fileFinding...)
 			}, nil
 		}
 	}
@@ -157,82 +286,257 @@ func (m *Masker) ParseFileType(path string, fileFinding []finding) (func() error
 		return nil, nil // noop
 	}
 
-	// Check if file valid utf
-	if !utf8.Valid(buf) {
-		m.logger.Debug("Invalid UTF-8.")
+	switch enc := m.encodingFor(path, buf); enc {
+	case encBinary:
 		return func() error {
-			return m.HandleBinary(path)
+			return m.HandleBinary(path, fileFinding...)
+		}, nil
+	case encUTF8:
+		if !utf8.Valid(buf) {
+			return nil, fmt.Errorf("%s is not valid UTF-8", path)
+		}
+		switch format := m.formatFor(path, string(buf)); format {
+		case formatPlain:
+		case formatNotebook:
+			return func() error {
+				return m.HandleNotebook(buf, path, fileFinding...)
+			}, nil
+		default:
+			return func() error {
+				return m.HandleStructured(buf, path, format, fileFinding...)
+			}, nil
+		}
+		return func() error {
+			return m.HandleText(buf, path, fileFinding...)
+		}, nil
+	default:
+		return func() error {
+			return m.HandleEncodedText(buf, path, enc, fileFinding...)
 		}, nil
 	}
-	return func() error {
-		return m.HandleText(buf, path, fileFinding...)
-	}, nil
 }
 
-// RecreateFile recreates a file with the given lines
-func (m *Masker) RecreateFile(path string, lines ...string) error {
+// RecreateFile recreates a file with the given content, keeping its permissions
+func (m *Masker) RecreateFile(path string, content []byte) error {
 	m.logger.Debug("Recreating file")
 
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Error reading file info: %v", err)
+	}
+
 	if err := os.Remove(path); err != nil {
 		return fmt.Errorf("Error deleting file: %v", err)
 	}
 
-	f, err := os.Create(path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
 	if err != nil {
 		return fmt.Errorf("Error creating empty file: %v", err)
 	}
 	defer f.Close()
 
-	if len(lines) > 0 {
-		content := strings.Join(lines, m.newLineSequence)
-		if _, err := f.WriteString(content); err != nil {
-			return fmt.Errorf("Error writing to file: %v", err)
-		}
+	if _, err := f.Write(content); err != nil {
+		return fmt.Errorf("Error writing to file: %v", err)
 	}
 	return nil
 }
 
-// HandleBinary processes binary files with sensitive data
-func (m *Masker) HandleBinary(path string) error {
-	var err error
+// HandleBinary processes binary files with sensitive data, using the strictest
+// binary strategy of the findings
+func (m *Masker) HandleBinary(path string, findings ...finding) error {
+	strategy := m.binaryStrategy(path, findings)
+	if strategy == BinaryKeep {
+		m.logger.Warning("Keeping binary file %s with %d finding(s) by policy", path, len(findings))
+		return nil
+	}
+
+	note := m.binaryNote(path, strategy, findings)
 
-	// Recreate file to remove its contents
-	if err = m.RecreateFile(path); err != nil {
-		return fmt.Errorf("Error recreating file: %v", err)
+	switch strategy {
+	case BinaryStub:
+		if err := m.RecreateFile(path, note); err != nil {
+			return fmt.Errorf("Error recreating file: %v", err)
+		}
+		return nil
+	case BinaryDelete:
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("Error deleting file: %v", err)
+		}
+	default:
+		if err := m.RecreateFile(path, nil); err != nil {
+			return fmt.Errorf("Error recreating file: %v", err)
+		}
 	}
-	// Create .txt file containing reference to the original file
-	txtFile := strings.TrimSuffix(path, ".p12") + ".txt"
-	if err = os.WriteFile(txtFile, fmt.Appendf(*new([]byte), placeholderPrefix, path), 0600); err != nil {
+
+	// Create a note next to the file referencing the original file
+	sidecar, err := writeSidecar(path, note)
+	if err != nil {
 		return fmt.Errorf("Error creating placeholder file: %v", err)
 	}
+	m.logger.Debug("Wrote note for %s to %s", path, sidecar)
 
 	return nil
 }
 
 // HandleText processes text files with sensitive data
 func (m *Masker) HandleText(buf []byte, path string, findings ...finding) error {
-	// Join all lines to create a single text buffer
-	fullText := string(buf)
+	masked, err := m.maskText(string(buf), path, findings...)
+
+	// Write the masked text back without touching the rest of the file
+	if err := m.RecreateFile(path, []byte(masked)); err != nil {
+		return fmt.Errorf("error recreating file: %v", err)
+	}
+
+	return err
+}
+
+// HandleEncodedText processes text files in encodings other than UTF-8. The file is
+// masked as UTF-8 and written back in its original encoding.
+func (m *Masker) HandleEncodedText(buf []byte, path string, enc textEncoding, findings ...finding) error {
+	text, err := enc.decode(buf)
+	if err != nil {
+		return fmt.Errorf("error decoding %s: %v", path, err)
+	}
+
+	masked, maskErr := m.maskContent(text, path, findings...)
+	out, err := enc.encode(masked)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", path, err)
+	}
+	if err := m.RecreateFile(path, out); err != nil {
+		return fmt.Errorf("error recreating file: %v", err)
+	}
+
+	return maskErr
+}
+
+// maskText replaces the secrets of the findings in the text. It returns the masked
+// text along with the errors of the findings that could not be masked.
+func (m *Masker) maskText(text, path string, findings ...finding) (string, error) {
+	// Only the secrets change, the byte order mark and line endings are kept as they are
+	layout := detectLayout(text)
+	fullText := layout.splitBOM(text)
+
+	replacements, err := m.replacements(fullText, layout, path, nil, findings)
+	fullText = applyReplacements(fullText, replacements)
+
+	return layout.joinBOM(fullText), err
+}
+
+// replacements locates every finding in the text and returns the spans to replace
+// with their placeholders. If given, variants returns other ways a secret may be
+// written, which are tried if the secret is not in the text as reported.
+func (m *Masker) replacements(fullText string, layout textLayout, path string, variants func(secret string) []string, findings []finding) ([]replacement, error) {
+	lines := newLineIndex(fullText)
+	m.logger.Debug("Detected %s line endings in %s (BOM: %t)", layout.eol, path, layout.bom)
 
 	// Clean up the filename for variable naming
 	maskPrefix := cleanFileName(path)
 
-	// Process each finding sequentially
+	// Locate every finding in the original text, so positions stay valid
+	var replacements []replacement
+	var masked []maskedSecret
+	var errs []error
 	for _, f := range findings {
-		// Replace the match with our placeholder
-		placeholder := fmt.Sprintf(m.placeholderMask, maskPrefix, f.RuleID, f.ID)
-		fullText = strings.Replace(fullText, f.Secret, placeholder, -1)
+		var spans []span
+		var err error
+		switch {
+		case f.Secret != "":
+			f.Secret = layout.adaptSecret(fullText, f.Secret)
+			if variants != nil && !strings.Contains(fullText, f.Secret) {
+				for _, v := range variants(f.Secret) {
+					if strings.Contains(fullText, v) {
+						f.Secret = v
+						break
+					}
+				}
+			}
+			spans, err = m.locate(fullText, lines, path, f)
+			if len(spans) == 0 {
+				// Multi-line secrets may be indented or end their lines differently in the file
+				if found, written := m.locateMultiline(fullText, lines, path, f); len(found) > 0 {
+					m.logger.Debug("Finding %s (%s) in %s matched with different line endings or indentation", f.ID, f.RuleID, path)
+					spans, f.Secret, err = found, written, nil
+				}
+			}
+		case f.HashedSecret != "":
+			// Only the hash is known, so the secret is looked up on the reported line
+			if f.Secret, err = resolveHashedSecret(fullText, lines, path, f); err == nil {
+				spans, err = locateInLines(fullText, lines, path, f)
+			}
+		default:
+			m.logger.Warning("Finding %s (%s) in %s has no secret, skipping", f.ID, f.RuleID, path)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(spans) > 0 && m.pemModeFor(path, f) == PEMBody {
+			// Only the body is replaced, so only the body is restored when unmasking
+			for i := range spans {
+				spans[i] = pemBody(fullText, spans[i])
+			}
+			f.Secret = fullText[spans[0].start:spans[0].end]
+		}
+
+		placeholder, err := m.placeholder(path, maskPrefix, f)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, s := range spans {
+			replacements = append(replacements, replacement{span: s, text: placeholder})
+		}
+		if len(spans) > 0 {
+			m.recordMasked(path, placeholder, f)
+			masked = append(masked, maskedSecret{f: f, placeholder: placeholder})
+		}
 	}
 
-	// Split text back into lines
-	updatedLines := strings.Split(fullText, m.newLineSequence)
+	if m.maskEncoded && len(masked) > 0 {
+		// Structured formats find JSON escaped secrets through their variants
+		encoded, derived := m.encodedReplacements(fullText, lines.position, path, variants != nil, masked, replacements)
+		replacements = append(replacements, encoded...)
+		m.recordDerived(path, derived)
+	}
 
-	// Recreate file with updated lines
-	if err := m.RecreateFile(path, updatedLines...); err != nil {
-		return fmt.Errorf("error recreating file: %v", err)
+	return replacements, errors.Join(errs...)
+}
+
+// policyFor returns the effective policy for a finding in the given target file
+func (m *Masker) policyFor(path string, f finding) Policy {
+	return m.policies.For(f.RuleID, relativeTo(m.targetDir, path))
+}
+
+// relativeTo returns path relative to dir, or path itself if it is not inside dir
+func relativeTo(dir, path string) string {
+	if filepath.IsAbs(dir) != filepath.IsAbs(path) {
+		// Compare absolute paths, Rel cannot mix relative and absolute ones
+		absDir, errDir := filepath.Abs(dir)
+		absPath, errPath := filepath.Abs(path)
+		if errDir == nil && errPath == nil {
+			dir, path = absDir, absPath
+		}
 	}
+	if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
 
-	return nil
+// targetPath maps the path of a finding into the target directory. Paths inside the
+// source directory are rebased, other relative paths are taken as relative to the
+// scanned repository, as reported by SARIF producers.
+func targetPath(sourceDir, targetDir, file string) string {
+	file = filepath.Clean(file)
+	if rel, err := filepath.Rel(sourceDir, file); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.Join(targetDir, rel)
+	}
+	if !filepath.IsAbs(file) {
+		return filepath.Join(targetDir, file)
+	}
+	return strings.NewReplacer(sourceDir, targetDir).Replace(file)
 }
 
 func cleanFileName(path string) string {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PEMMode controls how secrets holding PEM blocks, such as private keys and
+// certificates, are masked
+type PEMMode int
+
+const (
+	// PEMFull replaces the whole secret, including the BEGIN and END lines
+	PEMFull PEMMode = iota
+	// PEMBody keeps the BEGIN and END lines and replaces only the body between them
+	PEMBody
+)
+
+// String returns the string representation of the PEM mode
+func (pm PEMMode) String() string {
+	switch pm {
+	case PEMFull:
+		return "full"
+	case PEMBody:
+		return "body"
+	default:
+		return "unknown"
+	}
+}
+
+// ParsePEMMode parses a string into a PEMMode
+func ParsePEMMode(mode string) (PEMMode, error) {
+	switch strings.ToLower(mode) {
+	case "full":
+		return PEMFull, nil
+	case "body":
+		return PEMBody, nil
+	default:
+		return PEMFull, fmt.Errorf("unknown PEM mode: %s", mode)
+	}
+}
+
+// pemBlockPattern matches a PEM block. Scanners do not always report the dashes of
+// the armor lines, so they are optional.
+var pemBlockPattern = regexp.MustCompile(`(?s)-*BEGIN [A-Z0-9 ]*[A-Z0-9]-*(.*?)-*END [A-Z0-9 ]*[A-Z0-9]-*`)
+
+// pemBody returns the span of the body of the PEM block in s, without the armor
+// lines and the whitespace around the body. Spans that do not hold exactly one PEM
+// block are returned as they are.
+func pemBody(text string, s span) span {
+	blocks := pemBlockPattern.FindAllStringSubmatchIndex(text[s.start:s.end], -1)
+	if len(blocks) != 1 {
+		return s
+	}
+	start, end := s.start+blocks[0][2], s.start+blocks[0][3]
+	for start < end && strings.IndexByte(" \t\r\n", text[start]) >= 0 {
+		start++
+	}
+	for end > start && strings.IndexByte(" \t\r\n", text[end-1]) >= 0 {
+		end--
+	}
+	if start == end {
+		return s
+	}
+	return span{start: start, end: end}
+}
+
+// pemModeFor returns the PEM mode for a finding in the given file
+func (m *Masker) pemModeFor(path string, f finding) PEMMode {
+	if p := m.policyFor(path, f); p.PEMMode != "" {
+		mode, _ := ParsePEMMode(p.PEMMode) // validated when the config is loaded
+		return mode
+	}
+	return m.pemMode
+}
+
+// multilinePattern returns a pattern matching a multi-line secret regardless of its
+// line endings and of the indentation of its lines, e.g. a private key embedded in
+// a YAML file or a source file with CRLF line endings
+func multilinePattern(secret string) *regexp.Regexp {
+	lines := strings.Split(strings.ReplaceAll(secret, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = regexp.QuoteMeta(strings.TrimSpace(line))
+	}
+	return regexp.MustCompile(strings.Join(lines, `[ \t]*\r?\n[ \t]*`))
+}
+
+// multilineMatches returns the distinct ways a multi-line secret is written in the
+// text, in the order they first appear
+func multilineMatches(text, secret string) []string {
+	if !strings.Contains(strings.TrimSpace(secret), "\n") {
+		return nil
+	}
+	var written []string
+	seen := make(map[string]bool)
+	for _, match := range multilinePattern(secret).FindAllString(text, -1) {
+		if !seen[match] {
+			seen[match] = true
+			written = append(written, match)
+		}
+	}
+	return written
+}
+
+// locateMultiline locates a multi-line secret that is not in the text as reported,
+// e.g. because its lines are indented or end differently. It returns the spans of
+// every way the secret is written and the first of them, or no spans if the secret
+// is not in the text at all.
+func (m *Masker) locateMultiline(text string, lines lineIndex, path string, f finding) ([]span, string) {
+	var spans []span
+	first := ""
+	for _, written := range multilineMatches(text, f.Secret) {
+		reformatted := f
+		reformatted.Secret = written
+		found, err := m.locate(text, lines, path, reformatted)
+		if err != nil || len(found) == 0 {
+			continue
+		}
+		spans = append(spans, found...)
+		if first == "" {
+			first = written
+		}
+	}
+	return spans, first
+}
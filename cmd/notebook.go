@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// jsonNode is a value of a JSON document along with its position in the text
+type jsonNode struct {
+	span
+	kind     byte        // '{' for objects, '[' for arrays, '"' for strings, 0 for other literals
+	keys     []string    // Keys of an object, in order
+	children []*jsonNode // Values of an object or array
+	text     string      // Value of a string
+}
+
+// get returns the value of the key of an object, or nil
+func (n *jsonNode) get(key string) *jsonNode {
+	if i := slices.Index(n.keys, key); i >= 0 {
+		return n.children[i]
+	}
+	return nil
+}
+
+// parseJSONTree parses a JSON document into a tree that keeps the position of every value
+func parseJSONTree(text string) (*jsonNode, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+
+	var parse func() (*jsonNode, error)
+	parse = func() (*jsonNode, error) {
+		// The offset is the end of the previous token, separators are not tokens
+		start := int(dec.InputOffset())
+		for start < len(text) && strings.IndexByte(" \t\r\n,:", text[start]) >= 0 {
+			start++
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		n := &jsonNode{span: span{start: start}}
+		switch t := tok.(type) {
+		case json.Delim:
+			n.kind = byte(t)
+			for dec.More() {
+				if t == '{' {
+					key, err := dec.Token()
+					if err != nil {
+						return nil, err
+					}
+					n.keys = append(n.keys, key.(string))
+				}
+				child, err := parse()
+				if err != nil {
+					return nil, err
+				}
+				n.children = append(n.children, child)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+		case string:
+			n.kind = '"'
+			n.text = t
+		}
+		n.end = int(dec.InputOffset())
+		return n, nil
+	}
+
+	root, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("unexpected data after the document")
+	}
+	return root, nil
+}
+
+// isNotebook reports whether the document has the top-level keys of nbformat 4
+func isNotebook(root *jsonNode) bool {
+	if root.kind != '{' {
+		return false
+	}
+	cells, version := root.get("cells"), root.get("nbformat")
+	if cells == nil || cells.kind != '[' || version == nil || version.kind != 0 {
+		return false
+	}
+	for _, cell := range cells.children {
+		if cell.kind != '{' || cell.get("cell_type") == nil || cell.get("source") == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// notebookText is a text of a notebook, stored as one string or as an array of
+// lines. Secrets may be split across the lines of an array.
+type notebookText struct {
+	lines  []*jsonNode
+	output bool // Part of the outputs of a cell
+}
+
+// joined returns the text and the offset of each line in it
+func (nt notebookText) joined() (string, []int) {
+	var b strings.Builder
+	offsets := make([]int, len(nt.lines))
+	for i, line := range nt.lines {
+		offsets[i] = b.Len()
+		b.WriteString(line.text)
+	}
+	return b.String(), offsets
+}
+
+// position returns the position in the document of an offset of the joined text,
+// given the line index of the document. Columns count the bytes of the text as
+// unescaped from its line.
+func (nt notebookText) position(lines lineIndex) func(offset int) (int, int) {
+	_, offsets := nt.joined()
+	return func(offset int) (int, int) {
+		i := sort.Search(len(offsets), func(i int) bool { return offsets[i] > offset }) - 1
+		line, column := lines.position(nt.lines[i].start + 1) // after the opening quote
+		return line, column + offset - offsets[i]
+	}
+}
+
+// rewrite returns the replacements of the lines of the text that the edits touch.
+// The touched lines are joined, edited and split into lines again, and written
+// with the separator used between the lines of the array.
+func (nt notebookText) rewrite(doc string, edits []replacement) []replacement {
+	text, offsets := nt.joined()
+	lineOf := func(offset int) int {
+		return sort.Search(len(offsets), func(i int) bool { return offsets[i] > offset }) - 1
+	}
+
+	sep := ", "
+	if len(nt.lines) > 1 {
+		sep = doc[nt.lines[0].end:nt.lines[1].start]
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var out []replacement
+	for i := 0; i < len(edits); {
+		// Edits touching overlapping lines are applied together
+		first, last := lineOf(edits[i].start), lineOf(edits[i].end-1)
+		j := i + 1
+		for ; j < len(edits) && lineOf(edits[j].start) <= last; j++ {
+			last = max(last, lineOf(edits[j].end-1))
+		}
+
+		from, to := offsets[first], offsets[last]+len(nt.lines[last].text)
+		var segment []replacement
+		for _, e := range edits[i:j] {
+			segment = append(segment, replacement{span: span{start: e.start - from, end: e.end - from}, text: e.text})
+		}
+		edited := applyReplacements(text[from:to], segment)
+
+		parts := []string{edited}
+		if len(nt.lines) > 1 {
+			parts = strings.SplitAfter(edited, "\n")
+			if len(parts) > 1 && parts[len(parts)-1] == "" {
+				parts = parts[:len(parts)-1]
+			}
+		}
+		for k, p := range parts {
+			parts[k], _ = jsonString{}.quote(p)
+		}
+		out = append(out, replacement{span: span{start: nt.lines[first].start, end: nt.lines[last].end}, text: strings.Join(parts, sep)})
+		i = j
+	}
+	return out
+}
+
+// notebookLineKeys are the keys whose arrays hold the lines of one text
+var notebookLineKeys = []string{"source", "text"}
+
+// notebookTexts returns the texts of a notebook: the sources and outputs of its
+// cells, stored as arrays of lines, and every other string on its own
+func notebookTexts(root *jsonNode) []notebookText {
+	var texts []notebookText
+	var walk func(n *jsonNode, key string, lines, output bool)
+	walk = func(n *jsonNode, key string, lines, output bool) {
+		switch n.kind {
+		case '"':
+			texts = append(texts, notebookText{lines: []*jsonNode{n}, output: output})
+		case '[':
+			if lines && len(n.children) > 0 && !slices.ContainsFunc(n.children, func(c *jsonNode) bool { return c.kind != '"' }) {
+				texts = append(texts, notebookText{lines: n.children, output: output})
+				return
+			}
+			for _, c := range n.children {
+				walk(c, key, false, output)
+			}
+		case '{':
+			for i, c := range n.children {
+				k := n.keys[i]
+				// Rich outputs are keyed by MIME type, with texts stored as lines
+				walk(c, k, slices.Contains(notebookLineKeys, k) || key == "data", output || k == "outputs")
+			}
+		}
+	}
+	walk(root, "", false, false)
+	return texts
+}
+
+// notebookSeparator matches the end of one line of a source array and the start of
+// the next, as it appears in secrets that scanners report across lines
+var notebookSeparator = regexp.MustCompile(`"\s*,\s*"`)
+
+// notebookSecrets returns the ways a reported secret may read in the texts of a
+// notebook: as reported, unescaped, and joined across lines
+func notebookSecrets(secret string) []string {
+	var secrets []string
+	for _, s := range []string{secret, jsonString{}.unescape(secret), jsonString{}.unescape(notebookSeparator.ReplaceAllString(secret, ""))} {
+		if s != "" && !slices.Contains(secrets, s) {
+			secrets = append(secrets, s)
+		}
+	}
+	return secrets
+}
+
+// HandleNotebook processes Jupyter notebooks with sensitive data
+func (m *Masker) HandleNotebook(buf []byte, path string, findings ...finding) error {
+	masked, err := m.maskNotebook(string(buf), path, findings...)
+
+	if err := m.RecreateFile(path, []byte(masked)); err != nil {
+		return fmt.Errorf("error recreating file: %v", err)
+	}
+
+	return err
+}
+
+// maskNotebook replaces the secrets of the findings in the cell sources, outputs and
+// metadata of a notebook. Secrets are searched in the texts of the notebook rather
+// than in the JSON, so secrets that are escaped or split across the lines of a
+// source are found as well. Only the lines holding secrets are rewritten. With
+// MaskEncoded, the encoded copies of the secrets in the texts are masked as well.
+// With StripOutputs, the outputs and execution counts of all code cells are removed.
+func (m *Masker) maskNotebook(text, path string, findings ...finding) (string, error) {
+	layout := detectLayout(text)
+	fullText := layout.splitBOM(text)
+
+	root, err := parseJSONTree(fullText)
+	if err != nil || !isNotebook(root) {
+		m.logger.Warning("%s is not a valid notebook, masking it as JSON", path)
+		return m.maskStructured(text, path, formatJSON, findings...)
+	}
+	texts := notebookTexts(root)
+	lines := newLineIndex(fullText)
+	maskPrefix := cleanFileName(path)
+
+	var replacements []replacement
+	if m.stripOutputs {
+		for _, cell := range root.get("cells").children {
+			if outputs := cell.get("outputs"); outputs != nil && len(outputs.children) > 0 {
+				replacements = append(replacements, replacement{span: outputs.span, text: "[]"})
+			}
+			if count := cell.get("execution_count"); count != nil && fullText[count.start:count.end] != "null" {
+				replacements = append(replacements, replacement{span: count.span, text: "null"})
+			}
+		}
+		m.logger.Debug("Stripping the outputs of %s", path)
+	}
+
+	edits := make([][]replacement, len(texts))
+	var secrets []maskedSecret
+	var errs []error
+	for _, f := range findings {
+		if f.Secret == "" && f.HashedSecret != "" {
+			// Only the hash is known, so the secret is looked up on the reported line
+			if f.Secret, err = resolveHashedSecret(fullText, lines, path, f); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if f.Secret == "" {
+			m.logger.Warning("Finding %s (%s) in %s has no secret, skipping", f.ID, f.RuleID, path)
+			continue
+		}
+
+		// In position mode, only the texts on the reported lines are searched
+		from, to := 0, len(fullText)
+		mode := m.matchMode
+		if p := m.policyFor(path, f); p.MatchMode != "" {
+			mode, _ = ParseMatchMode(p.MatchMode) // validated when the config is loaded
+		}
+		if mode == MatchPosition && f.StartLine > 0 {
+			if from, to, err = lineRange(fullText, lines, path, f); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+
+		placeholder, err := m.placeholder(path, maskPrefix, f)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		pemMode := m.pemModeFor(path, f)
+		found, kept := "", false
+		for _, secret := range notebookSecrets(f.Secret) {
+			for i, t := range texts {
+				if t.lines[len(t.lines)-1].end < from || t.lines[0].start > to {
+					continue
+				}
+				joined, _ := t.joined()
+				for _, s := range findAll(joined, secret, 0, len(joined)) {
+					if pemMode == PEMBody {
+						s = pemBody(joined, s)
+					}
+					edits[i] = append(edits[i], replacement{span: s, text: placeholder})
+					if found == "" {
+						found = joined[s.start:s.end]
+					}
+					kept = kept || !(t.output && m.stripOutputs)
+				}
+			}
+			if found != "" {
+				break
+			}
+		}
+		if found == "" {
+			errs = append(errs, fmt.Errorf("finding %s (%s): secret not found in the cells of %s", f.ID, f.RuleID, path))
+			continue
+		}
+		if kept {
+			secrets = append(secrets, maskedSecret{f: f, placeholder: placeholder})
+			secrets[len(secrets)-1].f.Secret = found
+			// The secret is restored into a JSON string
+			f.Secret = jsonString{}.escape(found)
+			m.recordMasked(path, placeholder, f)
+		}
+	}
+
+	if m.maskEncoded && len(secrets) > 0 {
+		for i, t := range texts {
+			if t.output && m.stripOutputs {
+				continue
+			}
+			joined, _ := t.joined()
+			encoded, derived := m.encodedReplacements(joined, t.position(lines), path, false, secrets, edits[i])
+			edits[i] = append(edits[i], encoded...)
+			m.recordDerived(path, derived)
+		}
+	}
+
+	for i, t := range texts {
+		if len(edits[i]) > 0 && !(t.output && m.stripOutputs) {
+			replacements = append(replacements, t.rewrite(fullText, edits[i])...)
+		}
+	}
+	masked := applyReplacements(fullText, replacements)
+
+	if root, err := parseJSONTree(masked); err != nil || !isNotebook(root) {
+		errs = append(errs, fmt.Errorf("masked %s is no longer a valid notebook", path))
+	}
+	return layout.joinBOM(masked), errors.Join(errs...)
+}
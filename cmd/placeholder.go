@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// maxPlaceholderArgs is the number of values passed to fmt placeholder templates:
+// 1. file prefix 2. rule ID 3. finding ID 4. sequence number of the secret within its rule
+const maxPlaceholderArgs = 4
+
+// placeholderValues describes the values passed to fmt placeholder templates
+const placeholderValues = "%[1]s file prefix, %[2]s rule ID, %[3]s finding ID and %[4]d sequence number"
+
+// placeholderData holds the named fields available to text/template placeholders.
+// The secret itself is deliberately not available.
+type placeholderData struct {
+	RuleID      string   // ID of the rule that triggered the finding
+	ID          string   // Unique ID of the finding
+	Fingerprint string   // Fingerprint reported by the scanner
+	StartLine   int      // Line where the finding starts
+	EndLine     int      // Line where the finding ends
+	StartColumn int      // Column where the finding starts
+	EndColumn   int      // Column where the finding ends
+	Entropy     float64  // Entropy score of the secret
+	Verified    bool     // Whether the scanner verified the secret is live
+	Scanners    []string // Scanners that reported the finding
+	Prefix      string   // File name without extension, cleaned for use in identifiers
+	Path        string   // Path of the file relative to the repository, with forward slashes
+	Hash        string   // Short HMAC of the secret with the ID key, or its unkeyed SHA-256 without one
+	Seq         int      // Sequence number of the secret within its rule
+}
+
+// samplePlaceholderData fills text/template placeholders once at startup. Every field
+// is set, so templates indexing or slicing a field, such as {{slice .Hash 0 4}} or
+// {{index .Scanners 0}}, are not rejected for what a real finding always has.
+var samplePlaceholderData = placeholderData{
+	RuleID:      "rule",
+	ID:          "id",
+	Fingerprint: "fingerprint",
+	StartLine:   1,
+	EndLine:     1,
+	StartColumn: 1,
+	EndColumn:   2,
+	Entropy:     1,
+	Verified:    true,
+	Scanners:    []string{"scanner"},
+	Prefix:      "prefix",
+	Path:        "path/file",
+	Hash:        "0123abcd",
+	Seq:         1,
+}
+
+// placeholderTemplate is a compiled placeholder, either a text/template or a fmt template
+type placeholderTemplate struct {
+	raw  string
+	tmpl *template.Template // nil for fmt templates
+}
+
+// parsePlaceholder compiles a placeholder template. Templates with {{ }} actions are
+// text/template templates with named fields, all others are fmt templates with
+// positional verbs, as long as each verb fits the type of the value it refers to.
+func parsePlaceholder(raw string) (*placeholderTemplate, error) {
+	if strings.Contains(raw, "{{") {
+		tmpl, err := template.New("placeholder").Option("missingkey=error").Parse(raw)
+		if err == nil {
+			// Execute once, so unknown fields are reported at startup
+			if err = tmpl.Execute(new(strings.Builder), samplePlaceholderData); err != nil {
+				return nil, fmt.Errorf("invalid placeholder %q: %v", raw, err)
+			}
+			return &placeholderTemplate{raw: raw, tmpl: tmpl}, nil
+		}
+		if count, _ := placeholderVerbs(raw); count == 0 {
+			return nil, fmt.Errorf("invalid placeholder %q: %v", raw, err)
+		}
+		// Braces around fmt verbs, e.g. {{masked_%s}}
+	}
+
+	count, indexed := placeholderVerbs(raw)
+	if !indexed && count > maxPlaceholderArgs {
+		return nil, fmt.Errorf("placeholder %q has %d verbs, but only %d values are available", raw, count, maxPlaceholderArgs)
+	}
+	// Fill once with sample values, so verbs of the wrong type and bad indexes are
+	// reported at startup instead of ending up in the masked files as %!d(string=...)
+	if sample := formatPlaceholder(raw, "prefix", "rule", "id", 1); strings.Contains(sample, "%!") {
+		return nil, fmt.Errorf("invalid placeholder %q: verbs do not match the values %s, e.g. %q", raw, placeholderValues, sample)
+	}
+	return &placeholderTemplate{raw: raw}, nil
+}
+
+// usesHash reports whether a placeholder template fills in the Hash field
+func usesHash(raw string) bool {
+	return strings.Contains(raw, "{{") && strings.Contains(raw, ".Hash")
+}
+
+// validatePlaceholder checks that a placeholder template can be compiled and filled
+func validatePlaceholder(raw string) error {
+	_, err := parsePlaceholder(raw)
+	return err
+}
+
+// execute fills the template with the data of a finding
+func (pt *placeholderTemplate) execute(data placeholderData) (string, error) {
+	if pt.tmpl == nil {
+		return formatPlaceholder(pt.raw, data.Prefix, data.RuleID, data.ID, data.Seq), nil
+	}
+
+	var b strings.Builder
+	if err := pt.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("error filling placeholder %q: %v", pt.raw, err)
+	}
+	return b.String(), nil
+}
+
+// placeholderVerbs counts the formatting verbs of a fmt template and reports whether it
+// uses explicit argument indexes such as %[4]d
+func placeholderVerbs(template string) (count int, indexed bool) {
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(template) && template[i] == '%' {
+			continue // escaped percent sign
+		}
+		// Skip flags, width, precision and argument index up to the verb
+		for i < len(template) && strings.IndexByte("+-# 0123456789.*[]", template[i]) >= 0 {
+			if template[i] == '[' {
+				indexed = true
+			}
+			i++
+		}
+		count++
+	}
+	return count, indexed
+}
+
+// formatPlaceholder fills a fmt template with the values of a finding. Only as many values
+// as the template has verbs are passed, so templates without verbs are used as they are.
+func formatPlaceholder(template, prefix, ruleID, id string, seq int) string {
+	args := []any{prefix, ruleID, id, seq}
+	count, indexed := placeholderVerbs(template)
+	if !indexed {
+		args = args[:min(count, len(args))]
+	}
+	return fmt.Sprintf(template, args...)
+}
+
+// placeholder returns the placeholder for a finding in the given file, using the
+// template of the most specific matching policy or the global mask
+func (m *Masker) placeholder(path, prefix string, f finding) (string, error) {
+	raw := m.placeholderMask
+	if p := m.policyFor(path, f); p.Placeholder != "" {
+		raw = p.Placeholder
+	}
+
+	pt, err := m.compilePlaceholder(raw)
+	if err != nil {
+		return "", err
+	}
+
+	secret := f.Secret
+	if secret == "" {
+		secret = f.HashedSecret
+	}
+
+	// Encoded copies are numbered like the secret they were derived from
+	seqID := f.ID
+	if f.DerivedFrom != "" {
+		seqID = f.DerivedFrom
+	}
+
+	return pt.execute(placeholderData{
+		RuleID:      f.RuleID,
+		ID:          f.ID,
+		Fingerprint: f.Fingerprint,
+		StartLine:   f.StartLine,
+		EndLine:     f.EndLine,
+		StartColumn: f.StartColumn,
+		EndColumn:   f.EndColumn,
+		Entropy:     f.Entropy,
+		Verified:    f.Verified,
+		Scanners:    f.Scanners,
+		Prefix:      prefix,
+		Path:        filepath.ToSlash(relativeTo(m.targetDir, path)),
+		Hash:        m.ids.hash(secret),
+		Seq:         m.sequence[seqID],
+	})
+}
+
+// compilePlaceholder returns the compiled template, compiling it on first use
+func (m *Masker) compilePlaceholder(raw string) (*placeholderTemplate, error) {
+	m.templatesMu.Lock()
+	defer m.templatesMu.Unlock()
+
+	if pt, ok := m.templates[raw]; ok {
+		return pt, nil
+	}
+	pt, err := parsePlaceholder(raw)
+	if err != nil {
+		return nil, err
+	}
+	m.templates[raw] = pt
+	return pt, nil
+}
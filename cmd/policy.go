@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Policy overrides how findings are handled for the rules or paths it matches
+type Policy struct {
+	Skip        bool   `yaml:"skip" toml:"skip"`               // Leave matching findings unmasked
+	MatchMode   string `yaml:"match-mode" toml:"match-mode"`   // Overrides --match-mode
+	Placeholder string `yaml:"placeholder" toml:"placeholder"` // Overrides --mask
+	Encoding    string `yaml:"encoding" toml:"encoding"`       // Encoding of matching files, only used in path policies
+	Binary      string `yaml:"binary" toml:"binary"`           // Overrides --binary
+	Format      string `yaml:"format" toml:"format"`           // Format of matching files, only used in path policies
+	PEMMode     string `yaml:"pem-mode" toml:"pem-mode"`       // Overrides --pem-mode
+	Verified    string `yaml:"verified" toml:"verified"`       // Which findings to mask by verification status
+}
+
+// VerifiedFilter selects findings by whether the scanner verified their secret
+type VerifiedFilter int
+
+const (
+	// VerifiedAny masks findings regardless of their verification status
+	VerifiedAny VerifiedFilter = iota
+	// VerifiedOnly masks only verified findings and leaves the others unmasked
+	VerifiedOnly
+	// VerifiedSkip leaves verified findings unmasked and masks the others
+	VerifiedSkip
+)
+
+// String returns the string representation of the verified filter
+func (vf VerifiedFilter) String() string {
+	switch vf {
+	case VerifiedAny:
+		return "any"
+	case VerifiedOnly:
+		return "only"
+	case VerifiedSkip:
+		return "skip"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseVerifiedFilter parses a string into a VerifiedFilter
+func ParseVerifiedFilter(filter string) (VerifiedFilter, error) {
+	switch strings.ToLower(filter) {
+	case "any":
+		return VerifiedAny, nil
+	case "only":
+		return VerifiedOnly, nil
+	case "skip":
+		return VerifiedSkip, nil
+	default:
+		return VerifiedAny, fmt.Errorf("unknown verified filter: %s", filter)
+	}
+}
+
+// merge overlays the non-zero settings of other onto the policy
+func (p Policy) merge(other Policy) Policy {
+	p.Skip = p.Skip || other.Skip
+	if other.MatchMode != "" {
+		p.MatchMode = other.MatchMode
+	}
+	if other.Placeholder != "" {
+		p.Placeholder = other.Placeholder
+	}
+	if other.Encoding != "" {
+		p.Encoding = other.Encoding
+	}
+	if other.Binary != "" {
+		p.Binary = other.Binary
+	}
+	if other.Format != "" {
+		p.Format = other.Format
+	}
+	if other.PEMMode != "" {
+		p.PEMMode = other.PEMMode
+	}
+	if other.Verified != "" {
+		p.Verified = other.Verified
+	}
+	return p
+}
+
+// skips reports whether the policy leaves the finding unmasked, because it skips
+// the finding outright or by its verification status
+func (p Policy) skips(f finding) bool {
+	if p.Skip {
+		return true
+	}
+	filter, _ := ParseVerifiedFilter(p.Verified) // validated when the config is loaded
+	return filter == VerifiedOnly && !f.Verified || filter == VerifiedSkip && f.Verified
+}
+
+// validate checks that all settings of the policy can be parsed
+func (p Policy) validate() error {
+	if p.MatchMode != "" {
+		if _, err := ParseMatchMode(p.MatchMode); err != nil {
+			return err
+		}
+	}
+	if p.Placeholder != "" {
+		if err := validatePlaceholder(p.Placeholder); err != nil {
+			return err
+		}
+	}
+	if p.Encoding != "" {
+		if _, err := ParseTextEncoding(p.Encoding); err != nil {
+			return err
+		}
+	}
+	if p.Binary != "" {
+		if _, err := ParseBinaryStrategy(p.Binary); err != nil {
+			return err
+		}
+	}
+	if p.Format != "" {
+		if _, err := ParseFileFormat(p.Format); err != nil {
+			return err
+		}
+	}
+	if p.PEMMode != "" {
+		if _, err := ParsePEMMode(p.PEMMode); err != nil {
+			return err
+		}
+	}
+	if p.Verified != "" {
+		if _, err := ParseVerifiedFilter(p.Verified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Policies holds the per-rule and per-path policies, keyed by glob
+type Policies struct {
+	Rules map[string]Policy // Keyed by rule ID glob, e.g. "aws-*"
+	Paths map[string]Policy // Keyed by glob of the path relative to the repository, e.g. "config/*.yaml"
+}
+
+// validate checks all globs and policies
+func (ps Policies) validate() error {
+	for kind, policies := range map[string]map[string]Policy{"rule": ps.Rules, "path": ps.Paths} {
+		for pattern, p := range policies {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid %s glob %q: %v", kind, pattern, err)
+			}
+			if err := p.validate(); err != nil {
+				return fmt.Errorf("invalid policy for %s %q: %v", kind, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// For returns the effective policy for a finding of the given rule in the given file.
+// Matching rule policies are applied first and path policies second, each from the
+// least to the most specific glob, so later policies override earlier ones.
+func (ps Policies) For(ruleID, relPath string) Policy {
+	var p Policy
+	for _, pattern := range matchingGlobs(ps.Rules, func(pattern string) bool {
+		ok, _ := path.Match(pattern, ruleID)
+		return ok
+	}) {
+		p = p.merge(ps.Rules[pattern])
+	}
+
+	return p.merge(ps.ForPath(relPath))
+}
+
+// ForPath returns the effective path policy for the given file
+func (ps Policies) ForPath(relPath string) Policy {
+	var p Policy
+	relPath = filepath.ToSlash(relPath)
+	for _, pattern := range matchingGlobs(ps.Paths, func(pattern string) bool {
+		return matchPath(pattern, relPath)
+	}) {
+		p = p.merge(ps.Paths[pattern])
+	}
+	return p
+}
+
+// matchingGlobs returns the globs matching the predicate, sorted from least to most specific
+func matchingGlobs(policies map[string]Policy, match func(pattern string) bool) []string {
+	var patterns []string
+	for pattern := range policies {
+		if match(pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) < len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	return patterns
+}
+
+// matchPath reports whether a slash-separated relative path matches the glob. Globs
+// without a slash are matched against each path element, so "*.pem" matches in any
+// directory. A glob matching a directory matches everything below it.
+func matchPath(pattern, relPath string) bool {
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	pattern = strings.Trim(pattern, "/")
+
+	elems := strings.Split(relPath, "/")
+	for i := range elems {
+		if !anchored {
+			if ok, _ := path.Match(pattern, elems[i]); ok {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, strings.Join(elems[:i+1], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
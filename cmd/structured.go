@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// fileFormat is the syntax of a structured text file, which must stay valid when
+// its values are masked
+type fileFormat int
+
+const (
+	// formatAuto detects the format from the file name and content
+	formatAuto fileFormat = iota
+	// formatPlain is text without a known structure, masked by plain replacement
+	formatPlain
+	// formatJSON is a JSON document
+	formatJSON
+	// formatYAML is a stream of YAML documents
+	formatYAML
+	// formatEnv is a dotenv file of KEY=VALUE lines
+	formatEnv
+	// formatINI is an INI file of sections and key = value lines
+	formatINI
+	// formatProperties is a Java properties file
+	formatProperties
+	// formatNotebook is a Jupyter notebook, a JSON document of cells
+	formatNotebook
+)
+
+// String returns the string representation of the file format
+func (ff fileFormat) String() string {
+	switch ff {
+	case formatAuto:
+		return "auto"
+	case formatPlain:
+		return "plain"
+	case formatJSON:
+		return "json"
+	case formatYAML:
+		return "yaml"
+	case formatEnv:
+		return "env"
+	case formatINI:
+		return "ini"
+	case formatProperties:
+		return "properties"
+	case formatNotebook:
+		return "notebook"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseFileFormat parses a string into a fileFormat
+func ParseFileFormat(format string) (fileFormat, error) {
+	switch strings.ToLower(format) {
+	case "", "auto":
+		return formatAuto, nil
+	case "plain", "text":
+		return formatPlain, nil
+	case "json":
+		return formatJSON, nil
+	case "yaml", "yml":
+		return formatYAML, nil
+	case "env", "dotenv":
+		return formatEnv, nil
+	case "ini":
+		return formatINI, nil
+	case "properties":
+		return formatProperties, nil
+	case "notebook", "ipynb":
+		return formatNotebook, nil
+	default:
+		return formatAuto, fmt.Errorf("unknown file format: %s", format)
+	}
+}
+
+// envLinePattern matches the assignments of dotenv files, to recognize them without an extension
+var envLinePattern = regexp.MustCompile(`^(export\s+)?[A-Za-z_][A-Za-z0-9_]*=`)
+
+// detectFormat detects the format of a file from its extension. Files without an
+// extension are sniffed: JSON documents, YAML streams starting with a document
+// marker and files of nothing but KEY=VALUE lines are recognized.
+func detectFormat(path, text string) fileFormat {
+	name := strings.ToLower(filepath.Base(path))
+	switch ext := filepath.Ext(name); {
+	case ext == ".json":
+		return formatJSON
+	case ext == ".yaml", ext == ".yml":
+		return formatYAML
+	case name == ".env", strings.HasPrefix(name, ".env."), ext == ".env":
+		return formatEnv
+	case ext == ".ini", ext == ".cfg":
+		return formatINI
+	case ext == ".properties":
+		return formatProperties
+	case ext == ".ipynb":
+		return formatNotebook
+	case ext != "":
+		return formatPlain
+	}
+
+	trimmed := strings.TrimSpace(strings.TrimPrefix(text, utf8BOM))
+	switch {
+	case trimmed == "":
+		return formatPlain
+	case (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid([]byte(trimmed)):
+		return formatJSON
+	case strings.HasPrefix(trimmed, "---\n"), strings.HasPrefix(trimmed, "---\r\n"), strings.HasPrefix(trimmed, "%YAML"):
+		return formatYAML
+	}
+	for _, line := range strings.Split(trimmed, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") && !envLinePattern.MatchString(line) {
+			return formatPlain
+		}
+	}
+	return formatEnv
+}
+
+// formatFor returns the format configured for the path, or detects it
+func (m *Masker) formatFor(path, text string) fileFormat {
+	format, _ := ParseFileFormat(m.policies.ForPath(relativeTo(m.targetDir, path)).Format) // validated when the config is loaded
+	if format == formatAuto {
+		format = detectFormat(path, text)
+		m.logger.Debug("Detected %s format.", format)
+	}
+	return format
+}
+
+// document is the result of scanning a structured text file
+type document struct {
+	keys   []string // Keys in the order they appear, to check that masking kept the structure
+	values []value  // String values that may hold secrets
+}
+
+// value is a string value of a structured text file
+type value struct {
+	span             // Bytes of the value as written, including quotes
+	text  string     // The value after unquoting and unescaping
+	style valueStyle // How the value is written
+}
+
+// valueStyle is a way of writing a string value, such as a JSON string or a
+// single-quoted YAML scalar
+type valueStyle interface {
+	// decode returns the value written as raw, or false if raw is not valid in this style
+	decode(raw string) (string, bool)
+	// quote writes the value in this style, or in the closest style that can hold it
+	quote(value string) (string, bool)
+	// unescape returns the value of a fragment of a raw value, such as a secret
+	unescape(fragment string) string
+}
+
+// scan scans the keys and string values of a file in the format
+func (ff fileFormat) scan(text string) (document, error) {
+	switch ff {
+	case formatJSON, formatNotebook:
+		return scanJSON(text)
+	case formatYAML:
+		return scanYAML(text)
+	case formatEnv:
+		return scanEnv(text)
+	case formatINI:
+		return scanINI(text)
+	case formatProperties:
+		return scanProperties(text)
+	default:
+		return document{}, fmt.Errorf("cannot scan %s files", ff)
+	}
+}
+
+// variants returns the ways a secret may be written in a file of the format, for
+// scanners that report secrets unescaped
+func (ff fileFormat) variants(secret string) []string {
+	switch ff {
+	case formatJSON, formatNotebook:
+		return []string{jsonString{}.escape(secret)}
+	case formatYAML:
+		variants := []string{yamlDoubleQuoted{}.escape(secret), strings.ReplaceAll(secret, "'", "''")}
+		if strings.Contains(secret, "\n") {
+			// Lines of block scalars are indented
+			for indent := 1; indent <= 16; indent++ {
+				variants = append(variants, strings.ReplaceAll(secret, "\n", "\n"+strings.Repeat(" ", indent)))
+			}
+		}
+		return variants
+	case formatEnv:
+		return []string{envDoubleQuoted{}.escape(secret)}
+	case formatProperties:
+		return []string{propertiesValue{}.escape(secret)}
+	default:
+		return nil
+	}
+}
+
+// HandleStructured processes JSON, YAML, dotenv, INI and properties files with
+// sensitive data, keeping them valid. Files that cannot be masked without
+// breaking them are left as they are and reported.
+func (m *Masker) HandleStructured(buf []byte, path string, format fileFormat, findings ...finding) error {
+	masked, err := m.maskStructured(string(buf), path, format, findings...)
+	if errors.Is(err, errBrokenStructure) {
+		return err
+	}
+
+	if err := m.RecreateFile(path, []byte(masked)); err != nil {
+		return fmt.Errorf("error recreating file: %v", err)
+	}
+
+	return err
+}
+
+// maskContent masks the text of a file, keeping it valid if it has a structured format
+func (m *Masker) maskContent(text, path string, findings ...finding) (string, error) {
+	switch format := m.formatFor(path, text); format {
+	case formatPlain:
+		return m.maskText(text, path, findings...)
+	case formatNotebook:
+		return m.maskNotebook(text, path, findings...)
+	default:
+		return m.maskStructured(text, path, format, findings...)
+	}
+}
+
+// errBrokenStructure is returned when a structured text file no longer scans once
+// masked, in which case it is left as it is
+var errBrokenStructure = errors.New("masking would break the file")
+
+// maskStructured replaces the secrets of the findings in a structured text file.
+// Secrets are located like in plain text, and the placeholder is written into the
+// value holding the secret with the quoting and escaping of that value. If that
+// does not give the intended value, e.g. because the secret was escaped or the
+// placeholder needs quotes, the whole value is written anew. If the masked file
+// does not scan with the same keys as the original one, every value holding a
+// secret is written anew. If it still does not scan, the original text is returned
+// with errBrokenStructure; if the keys still differ, an error is returned.
+func (m *Masker) maskStructured(text, path string, format fileFormat, findings ...finding) (string, error) {
+	layout := detectLayout(text)
+	fullText := layout.splitBOM(text)
+
+	original, err := format.scan(fullText)
+	if err != nil {
+		m.logger.Warning("%s is not valid %s, masking it as plain text: %v", path, format, err)
+		return m.maskText(text, path, findings...)
+	}
+
+	replacements, maskErr := m.replacements(fullText, layout, path, format.variants, findings)
+	masked := applyReplacements(fullText, fitValues(fullText, original.values, replacements, false))
+
+	after, err := format.scan(masked)
+	if err != nil || !slices.Equal(original.keys, after.keys) {
+		m.logger.Debug("Masking broke the structure of %s, writing the values with secrets anew", path)
+		masked = applyReplacements(fullText, fitValues(fullText, original.values, replacements, true))
+		after, err = format.scan(masked)
+	}
+	switch {
+	case err != nil:
+		return text, errors.Join(maskErr, fmt.Errorf("%w: masked %s is no longer valid %s, leaving it unmasked: %v", errBrokenStructure, path, format, err))
+	case !slices.Equal(original.keys, after.keys):
+		maskErr = errors.Join(maskErr, fmt.Errorf("masking changed the keys of %s", path))
+	}
+
+	return layout.joinBOM(masked), maskErr
+}
+
+// fitValues fits the replacements inside values to the way the values are written.
+// Replacements that give the intended value are kept, all replacements inside a
+// value that do not are replaced by one that writes the whole value anew. With
+// whole, every value with replacements is written anew.
+func fitValues(text string, values []value, replacements []replacement, whole bool) []replacement {
+	var fitted []replacement
+	used := make([]bool, len(replacements))
+	for _, v := range values {
+		var inside []replacement
+		for i, r := range replacements {
+			if !used[i] && r.start >= v.start && r.end <= v.end {
+				used[i] = true
+				inside = append(inside, replacement{span: span{start: r.start - v.start, end: r.end - v.start}, text: r.text})
+			}
+		}
+		if len(inside) == 0 {
+			continue
+		}
+
+		raw := text[v.start:v.end]
+		want := v.text
+		for _, r := range inside {
+			want = strings.ReplaceAll(want, v.style.unescape(raw[r.start:r.end]), r.text)
+		}
+		if got, ok := v.style.decode(applyReplacements(raw, slices.Clone(inside))); ok && got == want && !whole {
+			for _, r := range inside {
+				fitted = append(fitted, replacement{span: span{start: r.start + v.start, end: r.end + v.start}, text: r.text})
+			}
+			continue
+		}
+		if quoted, ok := v.style.quote(want); ok {
+			fitted = append(fitted, replacement{span: v.span, text: quoted})
+			continue
+		}
+		// The value cannot hold the placeholder, the structure check reports it
+		for _, r := range inside {
+			fitted = append(fitted, replacement{span: span{start: r.start + v.start, end: r.end + v.start}, text: r.text})
+		}
+	}
+
+	// Replacements outside of values, e.g. in comments, are kept as they are
+	for i, r := range replacements {
+		if !used[i] {
+			fitted = append(fitted, r)
+		}
+	}
+	return fitted
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	cp "github.com/otiai10/copy"
+)
+
+const syncStateVersion = 1
+
+// syncState records what was masked by the last sync of a target directory
+type syncState struct {
+	Version int                  `json:"version"`
+	Options string               `json:"options"` // Digest of the options the files were masked with
+	Files   map[string]syncEntry `json:"files"`   // Synced files, by slash-separated path relative to the target
+}
+
+// syncEntry records a synced file as it was in the source and after masking
+type syncEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Source   string    `json:"source"`             // SHA-256 of the source file
+	Target   string    `json:"target,omitempty"`   // SHA-256 of the masked file, empty if masking removed it
+	Findings string    `json:"findings,omitempty"` // Digest of the findings of the file
+}
+
+// loadSyncState reads the state file of a target directory. A missing state file
+// yields an empty state, so every file is copied and masked.
+func loadSyncState(path string) (*syncState, error) {
+	state := &syncState{Version: syncStateVersion, Files: make(map[string]syncEntry)}
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync state: %v", err)
+	}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, fmt.Errorf("error parsing sync state %s: %v", path, err)
+	}
+	if state.Version != syncStateVersion {
+		return nil, fmt.Errorf("unsupported sync state version %d in %s", state.Version, path)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]syncEntry)
+	}
+	return state, nil
+}
+
+// save writes the state file
+func (s *syncState) save(path string) error {
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling sync state: %v", err)
+	}
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		return fmt.Errorf("error writing sync state: %v", err)
+	}
+	return nil
+}
+
+// record stores the hashes of the masked files, to detect changes to the target
+// on the next sync
+func (s *syncState) record(targetDir string, files pathSet, options string) error {
+	for rel := range files {
+		hash, err := hashFile(filepath.Join(targetDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		entry := s.Files[rel]
+		entry.Target = hash
+		s.Files[rel] = entry
+	}
+	s.Options = options
+	return nil
+}
+
+// hashFile returns the SHA-256 of a file, or of the target of a symbolic link. It
+// returns an empty string if the file does not exist.
+func hashFile(path string) (string, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, "symlink:"+link)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error hashing %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// optionsDigest returns a digest of the options that change how files are masked,
+// so every file is masked again when they change
+func optionsDigest(opts MaskerOptions) string {
+	opts.SkipFile = nil
+	sum := sha256.Sum256(fmt.Appendf(nil, "%+v", opts))
+	return hex.EncodeToString(sum[:])
+}
+
+// findingDigests returns a digest of the findings of each file, by slash-separated
+// path relative to the target, so files are masked again when their findings change.
+// Findings inside archives count for the archive.
+func findingDigests(sourceDir, targetDir string, findings []finding) map[string]string {
+	lines := make(map[string][]string)
+	for _, f := range findings {
+		if f.File == "" {
+			continue
+		}
+		archive, member := splitArchivePath(f.File)
+		rel := filepath.ToSlash(relativeTo(targetDir, targetPath(sourceDir, targetDir, archive)))
+		lines[rel] = append(lines[rel], fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\x00%d:%d-%d:%d",
+			f.RuleID, member, f.Fingerprint, f.Secret, f.HashedSecret, f.StartLine, f.StartColumn, f.EndLine, f.EndColumn))
+	}
+
+	digests := make(map[string]string, len(lines))
+	for rel, l := range lines {
+		slices.Sort(l)
+		sum := sha256.Sum256([]byte(strings.Join(l, "\n")))
+		digests[rel] = hex.EncodeToString(sum[:])
+	}
+	return digests
+}
+
+// syncPlan lists what a sync changed in the target directory
+type syncPlan struct {
+	changed   pathSet  // Files copied from the source, to be masked
+	unchanged pathSet  // Files masked by an earlier sync and left as they are
+	removed   []string // Files removed from the target since they are gone from the source
+}
+
+// syncTree brings a target directory masked by an earlier sync up to date with the
+// source. Files are copied if they are new, their size, modification time and hash
+// changed in the source, their findings or the options changed, or the masked file
+// in the target was changed since. Files of the last sync that are gone from the
+// source, or are now excluded, are removed along with the notes of binary files.
+// Files the state does not know about are never removed.
+func syncTree(sourceDir, targetDir string, im *ignoreMatcher, gitMode GitMode, state *syncState, options string, digests map[string]string) (syncPlan, error) {
+	plan := syncPlan{changed: make(pathSet), unchanged: make(pathSet)}
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return plan, fmt.Errorf("error creating target directory: %v", err)
+	}
+	err := filepath.WalkDir(sourceDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := filepath.ToSlash(relativeTo(sourceDir, path))
+		if rel == "." {
+			return nil
+		}
+
+		skip := false
+		if isGitDir(rel) {
+			skip = gitMode != GitKeep
+		} else if skip, err = im.excluded(rel, d.IsDir()); err != nil {
+			return err
+		}
+		if skip && d.IsDir() {
+			return filepath.SkipDir
+		}
+		if skip || d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		prev, known := state.Files[rel]
+		entry := syncEntry{Size: info.Size(), ModTime: info.ModTime().UTC(), Source: prev.Source, Findings: digests[rel]}
+		if !known || entry.Size != prev.Size || !entry.ModTime.Equal(prev.ModTime) {
+			if entry.Source, err = hashFile(path); err != nil {
+				return err
+			}
+		}
+		dest := filepath.Join(targetDir, filepath.FromSlash(rel))
+		target, err := hashFile(dest)
+		if err != nil {
+			return err
+		}
+
+		if known && state.Options == options && entry.Source == prev.Source && entry.Findings == prev.Findings && target == prev.Target {
+			entry.Target = prev.Target
+			state.Files[rel] = entry
+			plan.unchanged[rel] = true
+			return nil
+		}
+
+		// The copy replaces the masked file and the note of a binary file
+		if err := removeSynced(dest); err != nil {
+			return err
+		}
+		if err := cp.Copy(path, dest); err != nil {
+			return err
+		}
+		state.Files[rel] = entry
+		plan.changed[rel] = true
+		return nil
+	})
+	if err != nil {
+		return plan, err
+	}
+
+	for rel := range state.Files {
+		if plan.changed[rel] || plan.unchanged[rel] {
+			continue
+		}
+		if err := removeSynced(filepath.Join(targetDir, filepath.FromSlash(rel))); err != nil {
+			return plan, err
+		}
+		removeEmptyDirs(targetDir, filepath.Dir(filepath.Join(targetDir, filepath.FromSlash(rel))))
+		delete(state.Files, rel)
+		plan.removed = append(plan.removed, rel)
+	}
+	slices.Sort(plan.removed)
+	return plan, nil
+}
+
+// removeSynced removes a file of the target directory and the notes left behind
+// for it if it was a binary file
+func removeSynced(path string) error {
+	paths := []string{path, path + ".masked.txt"}
+	for i := 2; i <= maxSidecars; i++ {
+		paths = append(paths, fmt.Sprintf("%s.masked.%d.txt", path, i))
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents up to the root as long as they are empty
+func removeEmptyDirs(root, dir string) {
+	for isInside(root, dir) && filepath.Clean(dir) != filepath.Clean(root) {
+		if os.Remove(dir) != nil {
+			return // not empty
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// mergeSyncedResults adds the grouped findings of an earlier sync, read from the
+// output file, for the files that were left as they are
+func mergeSyncedResults(outputPath, targetDir string, results map[string][]finding, plan syncPlan) (map[string][]finding, error) {
+	raw, err := os.ReadFile(outputPath)
+	if os.IsNotExist(err) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading earlier file findings: %v", err)
+	}
+	var earlier map[string][]finding
+	if err := json.Unmarshal(raw, &earlier); err != nil {
+		return nil, fmt.Errorf("error parsing earlier file findings %s: %v", outputPath, err)
+	}
+
+	merged := make(map[string][]finding, len(results))
+	for path, findings := range earlier {
+		if _, ok := results[path]; !ok && plan.unchanged[filepath.ToSlash(relativeTo(targetDir, path))] {
+			merged[path] = findings
+		}
+	}
+	for path, findings := range results {
+		merged[path] = findings
+	}
+	return merged, nil
+}
+
+// mergeSyncedVault adds the entries of the vault of an earlier sync for the files
+// that were left as they are, so the vault restores the whole target
+func mergeSyncedVault(path string, material []byte, entries []vaultEntry, plan syncPlan) ([]vaultEntry, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return entries, nil
+	}
+	earlier, err := readVault(path, material)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range earlier {
+		if file, _ := splitArchivePath(e.File); plan.unchanged[file] {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].File != entries[j].File {
+			return entries[i].File < entries[j].File
+		}
+		return entries[i].Placeholder < entries[j].Placeholder
+	})
+	return entries, nil
+}
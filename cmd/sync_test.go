@@ -0,0 +1,117 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSyncTree(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	write := func(dir, name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("Failed to create directory of %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	read := func(name string) string {
+		t.Helper()
+		content, err := os.ReadFile(filepath.Join(targetDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		return string(content)
+	}
+
+	write(sourceDir, "app.conf", "password=s3cr3t\n")
+	write(sourceDir, "keystore.jks", "binary")
+	write(sourceDir, "README.md", "# Project\n")
+	write(sourceDir, "old/notes.txt", "notes\n")
+	write(sourceDir, "token.txt", "token=t0k3n\n")
+	im := newIgnoreMatcher(sourceDir, []string{maskerIgnoreFile}, nil, nil)
+	digests := map[string]string{"app.conf": "a", "keystore.jks": "b", "token.txt": "c"}
+
+	// The first sync copies everything
+	state := &syncState{Files: make(map[string]syncEntry)}
+	plan, err := syncTree(sourceDir, targetDir, im, GitDrop, state, "options", digests)
+	if err != nil {
+		t.Fatalf("syncTree failed: %v", err)
+	}
+	if got := slices.Sorted(maps.Keys(plan.changed)); !slices.Equal(got, []string{"README.md", "app.conf", "keystore.jks", "old/notes.txt", "token.txt"}) {
+		t.Fatalf("Expected every file to be copied, got %v", got)
+	}
+
+	// Masking as the masker would, the binary file is replaced by its note
+	write(targetDir, "app.conf", "password=<password>\n")
+	write(targetDir, "token.txt", "token=<token>\n")
+	write(targetDir, "keystore.jks.masked.txt", "note\n")
+	if err := os.Remove(filepath.Join(targetDir, "keystore.jks")); err != nil {
+		t.Fatalf("Failed to remove keystore.jks: %v", err)
+	}
+	if err := state.record(targetDir, plan.changed, "options"); err != nil {
+		t.Fatalf("record failed: %v", err)
+	}
+
+	// Changes in the source, the findings and the target since the first sync
+	write(sourceDir, "app.conf", "password=n3w-s3cr3t\n")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(sourceDir, "app.conf"), later, later); err != nil {
+		t.Fatalf("Failed to touch app.conf: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(sourceDir, "old")); err != nil {
+		t.Fatalf("Failed to remove old: %v", err)
+	}
+	write(sourceDir, "new.txt", "new\n")
+	write(targetDir, "README.md", "# Edited\n")
+	write(targetDir, "unknown.txt", "not synced\n")
+	digests["token.txt"] = "changed"
+
+	plan, err = syncTree(sourceDir, targetDir, im, GitDrop, state, "options", digests)
+	if err != nil {
+		t.Fatalf("syncTree failed: %v", err)
+	}
+	if got := slices.Sorted(maps.Keys(plan.changed)); !slices.Equal(got, []string{"README.md", "app.conf", "new.txt", "token.txt"}) {
+		t.Errorf("Expected changed files to be copied again, got %v", got)
+	}
+	if got := slices.Sorted(maps.Keys(plan.unchanged)); !slices.Equal(got, []string{"keystore.jks"}) {
+		t.Errorf("Expected the masked binary file to be left as it is, got %v", got)
+	}
+	if !slices.Equal(plan.removed, []string{"old/notes.txt"}) {
+		t.Errorf("Expected removed files %v, got %v", []string{"old/notes.txt"}, plan.removed)
+	}
+	if got := read("app.conf"); got != "password=n3w-s3cr3t\n" {
+		t.Errorf("Expected app.conf to be copied again, got %q", got)
+	}
+	if got := read("README.md"); got != "# Project\n" {
+		t.Errorf("Expected the edited README.md to be restored, got %q", got)
+	}
+	if got := read("keystore.jks.masked.txt"); got != "note\n" {
+		t.Errorf("Expected the note of the unchanged binary file to be kept, got %q", got)
+	}
+	if got := read("unknown.txt"); got != "not synced\n" {
+		t.Errorf("Expected files unknown to the state to be kept, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "old")); !os.IsNotExist(err) {
+		t.Errorf("Expected the emptied directory to be removed, got %v", err)
+	}
+
+	// Changed options mask every file again
+	plan, err = syncTree(sourceDir, targetDir, im, GitDrop, state, "other options", digests)
+	if err != nil {
+		t.Fatalf("syncTree failed: %v", err)
+	}
+	if len(plan.unchanged) != 0 || len(plan.changed) != 5 {
+		t.Errorf("Expected every file to be copied again, got %d changed and %d unchanged", len(plan.changed), len(plan.unchanged))
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "keystore.jks.masked.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the note of the copied binary file to be removed, got %v", err)
+	}
+}
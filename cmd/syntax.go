@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// unescapeFragment returns the value of a fragment of a quoted value by decoding it
+// as a whole value. A trailing backslash, cut off from its escape sequence, is dropped.
+func unescapeFragment(style valueStyle, quote, fragment string) string {
+	for _, f := range []string{fragment, strings.TrimSuffix(fragment, `\`)} {
+		if v, ok := style.decode(quote + f + quote); ok {
+			return v
+		}
+	}
+	return fragment
+}
+
+// lineAt returns the start and end of the line containing offset i, excluding the
+// line feed and a carriage return before it
+func lineAt(text string, i int) (int, int) {
+	start := strings.LastIndexByte(text[:i], '\n') + 1
+	end := strings.IndexByte(text[i:], '\n')
+	if end < 0 {
+		end = len(text)
+	} else {
+		end += i
+	}
+	return start, len(strings.TrimSuffix(text[:end], "\r"))
+}
+
+// nextLine returns the offset of the line after the one ending at end
+func nextLine(text string, end int) int {
+	if i := strings.IndexByte(text[end:], '\n'); i >= 0 {
+		return end + i + 1
+	}
+	return len(text)
+}
+
+// lineNumber returns the 1-based number of the line containing offset i
+func lineNumber(text string, i int) int {
+	return strings.Count(text[:i], "\n") + 1
+}
+
+// jsonString is a JSON string literal
+type jsonString struct{}
+
+func (jsonString) decode(raw string) (string, bool) {
+	var s string
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+func (js jsonString) quote(v string) (string, bool) {
+	return `"` + js.escape(v) + `"`, true
+}
+
+func (js jsonString) unescape(fragment string) string {
+	return unescapeFragment(js, `"`, fragment)
+}
+
+// escape escapes a string for a JSON string literal, leaving HTML characters as they are
+func (jsonString) escape(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s) // strings always encode
+	out := strings.TrimSuffix(b.String(), "\n")
+	return out[1 : len(out)-1]
+}
+
+// scanJSON scans the keys and string values of a JSON document
+func scanJSON(text string) (document, error) {
+	var v any
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return document{}, err
+	}
+
+	// The document is valid, so every quote outside of strings starts a string
+	var doc document
+	for i := 0; i < len(text); i++ {
+		if text[i] != '"' {
+			continue
+		}
+		end := i + 1
+		for end < len(text) && text[end] != '"' {
+			if text[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		end++
+
+		s, _ := jsonString{}.decode(text[i:end])
+		if rest := strings.TrimLeft(text[end:], " \t\r\n"); strings.HasPrefix(rest, ":") {
+			doc.keys = append(doc.keys, s)
+		} else {
+			doc.values = append(doc.values, value{span: span{start: i, end: end}, text: s, style: jsonString{}})
+		}
+		i = end - 1
+	}
+	return doc, nil
+}
+
+// yamlScalar decodes raw as a YAML document holding a single string scalar of the given style
+func yamlScalar(raw string, style yaml.Style) (string, bool) {
+	var n yaml.Node
+	if err := yaml.Unmarshal([]byte(raw), &n); err != nil || len(n.Content) != 1 {
+		return "", false
+	}
+	s := n.Content[0]
+	if s.Kind != yaml.ScalarNode || s.ShortTag() != "!!str" || s.Style&^yaml.TaggedStyle != style {
+		return "", false
+	}
+	return s.Value, true
+}
+
+// yamlDoubleQuoted is a double-quoted YAML scalar, which can hold any string
+type yamlDoubleQuoted struct{}
+
+func (yamlDoubleQuoted) decode(raw string) (string, bool) {
+	return yamlScalar(raw, yaml.DoubleQuotedStyle)
+}
+
+func (yamlDoubleQuoted) quote(v string) (string, bool) {
+	out, err := yaml.Marshal(&yaml.Node{Kind: yaml.ScalarNode, Style: yaml.DoubleQuotedStyle, Value: v})
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(string(out), "\n"), true
+}
+
+func (yd yamlDoubleQuoted) unescape(fragment string) string {
+	return unescapeFragment(yd, `"`, fragment)
+}
+
+// escape escapes a string for a double-quoted YAML scalar
+func (yd yamlDoubleQuoted) escape(s string) string {
+	quoted, _ := yd.quote(s)
+	return strings.TrimSuffix(strings.TrimPrefix(quoted, `"`), `"`)
+}
+
+// yamlSingleQuoted is a single-quoted YAML scalar, where quotes are doubled
+type yamlSingleQuoted struct{}
+
+func (yamlSingleQuoted) decode(raw string) (string, bool) {
+	return yamlScalar(raw, yaml.SingleQuotedStyle)
+}
+
+func (yamlSingleQuoted) quote(v string) (string, bool) {
+	if strings.ContainsAny(v, "\n\r\t") {
+		return yamlDoubleQuoted{}.quote(v)
+	}
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'", true
+}
+
+func (yamlSingleQuoted) unescape(fragment string) string {
+	return strings.ReplaceAll(fragment, "''", "'")
+}
+
+// yamlPlain is an unquoted YAML scalar
+type yamlPlain struct {
+	flow bool // Inside a flow collection, where commas and brackets end the scalar
+}
+
+func (yamlPlain) decode(raw string) (string, bool) {
+	return yamlScalar(raw, 0)
+}
+
+func (yp yamlPlain) quote(v string) (string, bool) {
+	if s, ok := yp.decode(v); ok && s == v && !strings.Contains(v, "\n") && !(yp.flow && strings.ContainsAny(v, ",[]{}")) {
+		return v, true
+	}
+	return yamlDoubleQuoted{}.quote(v)
+}
+
+func (yamlPlain) unescape(fragment string) string {
+	return fragment
+}
+
+// yamlBlock is a literal or folded YAML block scalar
+type yamlBlock struct {
+	style  yaml.Style
+	indent string // Indentation of the content lines
+}
+
+func (yb yamlBlock) decode(raw string) (string, bool) {
+	return yamlScalar(raw+"\n", yb.style)
+}
+
+func (yamlBlock) quote(v string) (string, bool) {
+	// The indentation of a new block depends on its parent, a quoted scalar does not
+	return yamlDoubleQuoted{}.quote(v)
+}
+
+func (yb yamlBlock) unescape(fragment string) string {
+	return strings.ReplaceAll(fragment, "\n"+yb.indent, "\n")
+}
+
+// scanYAML scans the keys and string scalars of a stream of YAML documents
+func scanYAML(text string) (document, error) {
+	lines := newLineIndex(text)
+	var doc document
+
+	var walk func(n *yaml.Node, flow bool)
+	walk = func(n *yaml.Node, flow bool) {
+		flow = flow || n.Style&yaml.FlowStyle != 0
+		switch n.Kind {
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for _, c := range n.Content {
+				walk(c, flow)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				doc.keys = append(doc.keys, n.Content[i].Value)
+				walk(n.Content[i+1], flow)
+			}
+		case yaml.ScalarNode:
+			if v, ok := yamlValue(text, lines, n, flow); ok {
+				doc.values = append(doc.values, v)
+			}
+		}
+	}
+
+	dec := yaml.NewDecoder(strings.NewReader(text))
+	for {
+		var n yaml.Node
+		err := dec.Decode(&n)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return document{}, err
+		}
+		walk(&n, false)
+	}
+	return doc, nil
+}
+
+// yamlValue returns the span and style of a string scalar as written. Scalars whose
+// span cannot be told for sure, such as plain scalars spanning lines, are skipped.
+func yamlValue(text string, lines lineIndex, n *yaml.Node, flow bool) (value, bool) {
+	if n.ShortTag() != "!!str" {
+		return value{}, false
+	}
+
+	// Columns count characters, not bytes
+	start, ok := lines.lineStart(n.Line)
+	if !ok {
+		return value{}, false
+	}
+	for c := 1; c < n.Column && start < len(text); c++ {
+		_, size := utf8.DecodeRuneInString(text[start:])
+		start += size
+	}
+	// Skip tags and anchors in front of the scalar
+	for start < len(text) && (text[start] == '!' || text[start] == '&') {
+		for start < len(text) && !strings.ContainsRune(" \t\r\n", rune(text[start])) {
+			start++
+		}
+		for start < len(text) && (text[start] == ' ' || text[start] == '\t') {
+			start++
+		}
+	}
+	if start >= len(text) {
+		return value{}, false
+	}
+
+	var style valueStyle
+	end := start
+	switch n.Style &^ yaml.TaggedStyle {
+	case yaml.DoubleQuotedStyle:
+		style = yamlDoubleQuoted{}
+		for end++; end < len(text) && text[end] != '"'; end++ {
+			if text[end] == '\\' {
+				end++
+			}
+		}
+		end++
+	case yaml.SingleQuotedStyle:
+		style = yamlSingleQuoted{}
+		for end++; end < len(text); end++ {
+			if text[end] == '\'' {
+				if end+1 < len(text) && text[end+1] == '\'' {
+					end++
+					continue
+				}
+				break
+			}
+		}
+		end++
+	case yaml.LiteralStyle, yaml.FoldedStyle:
+		block := yamlBlock{style: n.Style &^ yaml.TaggedStyle}
+		lineStart, lineEnd := lineAt(text, start)
+		parentIndent := len(text[lineStart:lineEnd]) - len(strings.TrimLeft(text[lineStart:lineEnd], " "))
+		end = lineEnd
+		for next := nextLine(text, lineEnd); next < len(text); {
+			s, e := lineAt(text, next)
+			line := text[s:e]
+			indent := len(line) - len(strings.TrimLeft(line, " "))
+			if strings.TrimSpace(line) != "" {
+				if indent <= parentIndent {
+					break
+				}
+				if block.indent == "" {
+					block.indent = line[:indent]
+				}
+				end = e
+			}
+			next = nextLine(text, e)
+		}
+		style = block
+	default:
+		style = yamlPlain{flow: flow}
+		_, lineEnd := lineAt(text, start)
+		end = lineEnd
+		if i := strings.Index(text[start:end], " #"); i >= 0 {
+			end = start + i
+		}
+		if flow {
+			if i := strings.IndexAny(text[start:end], ",]}"); i >= 0 {
+				end = start + i
+			}
+		}
+		end = start + len(strings.TrimRight(text[start:end], " \t"))
+	}
+	if end > len(text) || end <= start {
+		return value{}, false
+	}
+
+	// Only values that decode to what the parser saw are masked structurally
+	if v, ok := style.decode(text[start:end]); !ok || v != n.Value {
+		return value{}, false
+	}
+	return value{span: span{start: start, end: end}, text: n.Value, style: style}, true
+}
+
+// envKeyPattern matches the variable names of dotenv files
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// envUnquoted is an unquoted dotenv value, taken as it is up to a comment. Loaders
+// accept whitespace inside, but shells sourcing the file do not, so new values with
+// whitespace are quoted.
+type envUnquoted struct{}
+
+func (envUnquoted) decode(raw string) (string, bool) {
+	if raw == "" || strings.ContainsAny(raw[:1], `"'`) || strings.ContainsAny(raw, " \t\r\n") {
+		return "", false
+	}
+	return raw, true
+}
+
+func (envUnquoted) quote(v string) (string, bool) {
+	if v == "" || strings.ContainsAny(v, " \t\r\n#\"'\\") {
+		return envDoubleQuoted{}.quote(v)
+	}
+	return v, true
+}
+
+func (envUnquoted) unescape(fragment string) string {
+	return fragment
+}
+
+// envSingleQuoted is a single-quoted dotenv value, taken literally
+type envSingleQuoted struct{}
+
+func (envSingleQuoted) decode(raw string) (string, bool) {
+	if len(raw) < 2 || raw[0] != '\'' || raw[len(raw)-1] != '\'' || strings.Contains(raw[1:len(raw)-1], "'") {
+		return "", false
+	}
+	return raw[1 : len(raw)-1], true
+}
+
+func (envSingleQuoted) quote(v string) (string, bool) {
+	if strings.Contains(v, "'") {
+		return envDoubleQuoted{}.quote(v)
+	}
+	return "'" + v + "'", true
+}
+
+func (envSingleQuoted) unescape(fragment string) string {
+	return fragment
+}
+
+// envDoubleQuoted is a double-quoted dotenv value with backslash escapes
+type envDoubleQuoted struct{}
+
+// envEscapes maps the escape sequences of double-quoted dotenv values to their characters
+var envEscapes = map[byte]string{'\\': `\`, '"': `"`, '\'': `'`, 'n': "\n", 'r': "\r", 't': "\t"}
+
+func (envDoubleQuoted) decode(raw string) (string, bool) {
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return "", false
+	}
+	var b strings.Builder
+	inner := raw[1 : len(raw)-1]
+	for i := 0; i < len(inner); i++ {
+		switch c := inner[i]; {
+		case c == '"':
+			return "", false
+		case c == '\\' && i+1 < len(inner):
+			if s, ok := envEscapes[inner[i+1]]; ok {
+				b.WriteString(s)
+				i++
+				continue
+			}
+			b.WriteByte(c)
+		case c == '\\':
+			return "", false
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), true
+}
+
+func (ed envDoubleQuoted) quote(v string) (string, bool) {
+	return `"` + ed.escape(v) + `"`, true
+}
+
+func (ed envDoubleQuoted) unescape(fragment string) string {
+	return unescapeFragment(ed, `"`, fragment)
+}
+
+// escape escapes a string for a double-quoted dotenv value
+func (envDoubleQuoted) escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// scanEnv scans the variables and values of a dotenv file
+func scanEnv(text string) (document, error) {
+	var doc document
+	for pos := 0; pos < len(text); {
+		lineStart, lineEnd := lineAt(text, pos)
+		line := strings.TrimSpace(text[lineStart:lineEnd])
+		if line == "" || strings.HasPrefix(line, "#") {
+			pos = nextLine(text, lineEnd)
+			continue
+		}
+
+		i := lineStart + strings.Index(text[lineStart:lineEnd], line)
+		if rest, ok := strings.CutPrefix(line, "export"); ok && strings.TrimLeft(rest, " \t") != rest {
+			i += len(line) - len(strings.TrimLeft(rest, " \t"))
+		}
+		eq := strings.IndexByte(text[i:lineEnd], '=')
+		if eq < 0 {
+			return document{}, fmt.Errorf("line %d is not a KEY=VALUE assignment", lineNumber(text, i))
+		}
+		key := strings.TrimSpace(text[i : i+eq])
+		if !envKeyPattern.MatchString(key) {
+			return document{}, fmt.Errorf("line %d has an invalid variable name %q", lineNumber(text, i), key)
+		}
+		doc.keys = append(doc.keys, key)
+
+		start := i + eq + 1
+		for start < lineEnd && (text[start] == ' ' || text[start] == '\t') {
+			start++
+		}
+		var style valueStyle
+		end := lineEnd
+		switch {
+		case start < lineEnd && text[start] == '"':
+			style = envDoubleQuoted{}
+			for end = start + 1; end < len(text) && text[end] != '"'; end++ {
+				if text[end] == '\\' {
+					end++
+				}
+			}
+			end++
+		case start < lineEnd && text[start] == '\'':
+			style = envSingleQuoted{}
+			end = start + 1 + strings.IndexByte(text[start+1:], '\'') + 1
+			if end == start+1 {
+				end = len(text) + 1
+			}
+		default:
+			style = envUnquoted{}
+			if j := strings.Index(text[start:end], " #"); j >= 0 {
+				end = start + j
+			}
+			end = start + len(strings.TrimRight(text[start:end], " \t"))
+		}
+		if end > len(text) {
+			return document{}, fmt.Errorf("line %d has an unterminated quoted value", lineNumber(text, start))
+		}
+
+		if end > start {
+			s, ok := style.decode(text[start:end])
+			if _, unquoted := style.(envUnquoted); unquoted {
+				s, ok = text[start:end], true
+			}
+			if !ok {
+				return document{}, fmt.Errorf("line %d has an invalid value", lineNumber(text, start))
+			}
+			doc.values = append(doc.values, value{span: span{start: start, end: end}, text: s, style: style})
+		}
+
+		// Only a comment may follow a quoted value
+		_, restEnd := lineAt(text, max(end-1, start))
+		if rest := strings.TrimSpace(text[min(end, restEnd):restEnd]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return document{}, fmt.Errorf("line %d has text after its value", lineNumber(text, end))
+		}
+		pos = nextLine(text, restEnd)
+	}
+	return doc, nil
+}
+
+// iniValue is the value of an INI key, taken as it is without surrounding whitespace
+type iniValue struct{}
+
+func (iniValue) decode(raw string) (string, bool) {
+	if strings.ContainsAny(raw, "\r\n") || strings.TrimSpace(raw) != raw {
+		return "", false
+	}
+	return raw, true
+}
+
+func (iv iniValue) quote(v string) (string, bool) {
+	_, ok := iv.decode(v)
+	return v, ok && v != ""
+}
+
+func (iniValue) unescape(fragment string) string {
+	return fragment
+}
+
+// scanINI scans the sections, keys and values of an INI file
+func scanINI(text string) (document, error) {
+	var doc document
+	inKey := false
+	for pos := 0; pos < len(text); {
+		lineStart, lineEnd := lineAt(text, pos)
+		raw := text[lineStart:lineEnd]
+		line := strings.TrimSpace(raw)
+		pos = nextLine(text, lineEnd)
+
+		switch {
+		case line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return document{}, fmt.Errorf("line %d has an unterminated section header", lineNumber(text, lineStart))
+			}
+			doc.keys = append(doc.keys, line)
+			inKey = false
+			continue
+		case inKey && strings.TrimLeft(raw, " \t") != raw:
+			continue // continuation of a multi-line value
+		}
+
+		sep := strings.IndexAny(raw, "=:")
+		if sep < 0 {
+			return document{}, fmt.Errorf("line %d is neither a section nor a key = value pair", lineNumber(text, lineStart))
+		}
+		doc.keys = append(doc.keys, strings.TrimSpace(raw[:sep]))
+		inKey = true
+
+		v := strings.TrimSpace(raw[sep+1:])
+		if v == "" {
+			continue
+		}
+		start := lineStart + sep + 1 + strings.Index(raw[sep+1:], v)
+		doc.values = append(doc.values, value{span: span{start: start, end: start + len(v)}, text: v, style: iniValue{}})
+	}
+	return doc, nil
+}
+
+// propertiesValue is the value of a Java properties entry, with backslash escapes
+// and line continuations
+type propertiesValue struct{}
+
+func (propertiesValue) decode(raw string) (string, bool) {
+	return propertiesUnescape(strings.TrimLeft(raw, " \t\f"))
+}
+
+func (pv propertiesValue) quote(v string) (string, bool) {
+	return pv.escape(v), true
+}
+
+func (propertiesValue) unescape(fragment string) string {
+	s, _ := propertiesUnescape(fragment)
+	return s
+}
+
+// escape escapes a string for a properties value
+func (propertiesValue) escape(s string) string {
+	out := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "\f", `\f`).Replace(s)
+	if strings.HasPrefix(out, " ") {
+		out = `\` + out
+	}
+	return out
+}
+
+// propertiesUnescape resolves the escapes and line continuations of properties keys
+// and values. It reports false for line breaks that are not escaped and for
+// malformed escapes.
+func propertiesUnescape(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\n' || c == '\r' {
+			return "", false
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return "", false
+		}
+		switch s[i] {
+		case '\r', '\n':
+			// Line continuation, the leading whitespace of the next line is dropped
+			if s[i] == '\r' && i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+			for i+1 < len(s) && strings.IndexByte(" \t\f", s[i+1]) >= 0 {
+				i++
+			}
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+5 > len(s) {
+				return "", false
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", false
+			}
+			i += 4
+			// Characters outside the BMP are written as surrogate pairs
+			if utf16.IsSurrogate(rune(r)) && i+7 <= len(s) && strings.HasPrefix(s[i+1:], `\u`) {
+				if low, err := strconv.ParseUint(s[i+3:i+7], 16, 16); err == nil {
+					b.WriteRune(utf16.DecodeRune(rune(r), rune(low)))
+					i += 6
+					continue
+				}
+			}
+			b.WriteRune(rune(r))
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), true
+}
+
+// scanProperties scans the keys and values of a Java properties file
+func scanProperties(text string) (document, error) {
+	var doc document
+	for pos := 0; pos < len(text); {
+		lineStart, lineEnd := lineAt(text, pos)
+		line := strings.TrimLeft(text[lineStart:lineEnd], " \t\f")
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			pos = nextLine(text, lineEnd)
+			continue
+		}
+
+		// A logical line continues while its physical lines end with an odd number of backslashes
+		end := lineEnd
+		for end < len(text) {
+			trailing := len(text[lineStart:end]) - len(strings.TrimRight(text[lineStart:end], `\`))
+			if trailing%2 == 0 {
+				break
+			}
+			next := nextLine(text, end)
+			if next >= len(text) {
+				break
+			}
+			_, end = lineAt(text, next)
+		}
+		pos = nextLine(text, end)
+
+		k := lineEnd - len(line)
+		i := k
+		for i < end && strings.IndexByte("=: \t\f", text[i]) < 0 {
+			if text[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		key, ok := propertiesUnescape(text[k:min(i, end)])
+		if !ok {
+			return document{}, fmt.Errorf("line %d has a malformed key", lineNumber(text, k))
+		}
+		doc.keys = append(doc.keys, key)
+
+		for i < end && strings.IndexByte(" \t\f", text[i]) >= 0 {
+			i++
+		}
+		if i < end && (text[i] == '=' || text[i] == ':') {
+			i++
+		}
+		for i < end && strings.IndexByte(" \t\f", text[i]) >= 0 {
+			i++
+		}
+		if i >= end {
+			continue
+		}
+		v, ok := propertiesValue{}.decode(text[i:end])
+		if !ok {
+			return document{}, fmt.Errorf("line %d has a malformed value", lineNumber(text, i))
+		}
+		doc.values = append(doc.values, value{span: span{start: i, end: end}, text: v, style: propertiesValue{}})
+	}
+	return doc, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// errNotArchive is returned for blobs of container images that are not layers
+var errNotArchive = errors.New("not an archive")
+
+// tarExtensions are the suffixes of tar archives, plain or compressed with gzip
+var tarExtensions = []string{".tar", ".tar.gz", ".tgz"}
+
+// ociBlobPattern matches the content-addressed blobs of OCI image layouts, which
+// hold the layers of an image without a file extension
+var ociBlobPattern = regexp.MustCompile(`(^|/)blobs/sha256/[0-9a-f]{64}$`)
+
+// isTarName reports whether the file name has the suffix of a tar archive
+func isTarName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range tarExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOCIBlob reports whether the path is a blob of an OCI image layout
+func isOCIBlob(name string) bool {
+	_, member := splitLastMember(name)
+	return ociBlobPattern.MatchString(member)
+}
+
+// splitLastMember splits the path of a nested archive member into the path of its
+// archive and the name of the member in it
+func splitLastMember(name string) (string, string) {
+	if i := strings.LastIndex(name, archiveSeparator); i >= 0 {
+		return name[:i], name[i+len(archiveSeparator):]
+	}
+	return "", name
+}
+
+// tarEntry is a member of a tar archive held in memory
+type tarEntry struct {
+	header  *tar.Header
+	content []byte
+}
+
+// readTar reads all entries of a tar archive, which may be compressed with gzip. It
+// returns the gzip header if it was compressed, and errNotArchive if it is neither.
+func readTar(buf []byte) ([]tarEntry, *gzip.Header, error) {
+	var gz *gzip.Header
+	data := buf
+	if bytes.HasPrefix(buf, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading gzip stream: %v", err)
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, nil, fmt.Errorf("error reading gzip stream: %v", err)
+		}
+		gz = &zr.Header
+	}
+	if len(data) < 262 || string(data[257:262]) != "ustar" {
+		return nil, nil, errNotArchive
+	}
+
+	var entries []tarEntry
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading tar archive: %v", err)
+		}
+		if hdr.Size > maxMemberSize {
+			return nil, nil, fmt.Errorf("%s is larger than %d bytes", hdr.Name, maxMemberSize)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading %s: %v", hdr.Name, err)
+		}
+		entries = append(entries, tarEntry{header: hdr, content: content})
+	}
+	return entries, gz, nil
+}
+
+// writeTar writes the entries as a tar archive, compressed with gzip if a gzip
+// header is given
+func writeTar(entries []tarEntry, gz *gzip.Header) ([]byte, error) {
+	var out bytes.Buffer
+	var w io.Writer = &out
+	var zw *gzip.Writer
+	if gz != nil {
+		zw = gzip.NewWriter(&out)
+		zw.Header = *gz
+		w = zw
+	}
+
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.header); err != nil {
+			return nil, fmt.Errorf("error writing %s: %v", e.header.Name, err)
+		}
+		if _, err := tw.Write(e.content); err != nil {
+			return nil, fmt.Errorf("error writing %s: %v", e.header.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("error writing tar archive: %v", err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("error writing gzip stream: %v", err)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// tarMemberName returns the name of a tar member as scanners report it, without a leading ./
+func tarMemberName(hdr *tar.Header) string {
+	return strings.TrimPrefix(path.Clean(hdr.Name), "./")
+}
+
+// rewriteTar rewrites the members of a tar archive selected by wants. All other
+// members are written back with their header, so order, timestamps, owners and
+// modes are kept. If the archive is a container image, the digests of changed
+// blobs are recomputed and updated in the manifests.
+func rewriteTar(buf []byte, wants func(member string) bool, edit memberFunc) ([]byte, error) {
+	entries, gz, err := readTar(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[tarMemberName(e.header)] = true
+	}
+
+	var out []tarEntry
+	changed := make(map[string][]byte) // Member name to original content
+	for _, e := range entries {
+		name := tarMemberName(e.header)
+		if e.header.Typeflag != tar.TypeReg || !wants(name) {
+			out = append(out, e)
+			continue
+		}
+
+		me, err := edit(name, e.content)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case me.remove:
+			changed[name] = e.content
+		case me.content != nil:
+			changed[name] = e.content
+			out = append(out, tarEntry{header: withSize(e.header, len(me.content)), content: me.content})
+		default:
+			out = append(out, e)
+		}
+		if me.note != nil {
+			hdr := withSize(e.header, len(me.note))
+			hdr.Name = freeName(e.header.Name+".masked", ".txt", names)
+			names[tarMemberName(hdr)] = true
+			out = append(out, tarEntry{header: hdr, content: me.note})
+		}
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	if isImage(out) {
+		updateImageDigests(out, changed)
+	}
+	return writeTar(out, gz)
+}
+
+// walkTar calls fn with the name and content of every regular file of a tar archive
+func walkTar(buf []byte, fn func(member string, content []byte) error) error {
+	entries, _, err := readTar(buf)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(tarMemberName(e.header), e.content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withSize returns a copy of the header for content of the given size
+func withSize(hdr *tar.Header, size int) *tar.Header {
+	h := *hdr
+	h.Size = int64(size)
+	if h.PAXRecords != nil {
+		// The size is derived from the header, a stale record would override it
+		h.PAXRecords = make(map[string]string, len(hdr.PAXRecords))
+		for k, v := range hdr.PAXRecords {
+			if k != "size" {
+				h.PAXRecords[k] = v
+			}
+		}
+	}
+	return &h
+}
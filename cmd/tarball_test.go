@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type tarMember struct {
+	name    string
+	mode    int64
+	content []byte
+}
+
+func buildTar(t *testing.T, members []tarMember, compress bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for i, m := range members {
+		hdr := &tar.Header{
+			Name:    m.name,
+			Mode:    m.mode,
+			Size:    int64(len(m.content)),
+			Uid:     1000,
+			Gid:     1000,
+			Uname:   "app",
+			ModTime: time.Date(2020, 1, 2, 3, 4, 5+i, 0, time.UTC),
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write(m.content); err != nil {
+			t.Fatalf("Failed to write tar member: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar: %v", err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Failed to close gzip: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func readTarMembers(t *testing.T, buf []byte) ([]*tar.Header, map[string][]byte) {
+	t.Helper()
+	entries, _, err := readTar(buf)
+	if err != nil {
+		t.Fatalf("Failed to read tar: %v", err)
+	}
+	headers := make([]*tar.Header, 0, len(entries))
+	contents := make(map[string][]byte)
+	for _, e := range entries {
+		headers = append(headers, e.header)
+		contents[tarMemberName(e.header)] = e.content
+	}
+	return headers, contents
+}
+
+func TestMasker_HandleArchive_Tar(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	archive := buildTar(t, []tarMember{
+		{name: "./etc/app.conf", mode: 0640, content: []byte("user=admin\npassword=s3cr3t\n")},
+		{name: "./bin/tool", mode: 0755, content: []byte{0x7f, 'E', 'L', 'F', 0x02, 0x01, 0x01, 0x00, 0xff, 0xd8, 0x00, 0x00, 0x03, 0x00, 0x3e, 0x00}},
+		{name: "./README", mode: 0644, content: []byte("nothing to see\n")},
+	}, true)
+	testFilePath := filepath.Join(tmpDir, "release.tar.gz")
+	if err := os.WriteFile(testFilePath, archive, 0600); err != nil {
+		t.Fatalf("Failed to write test archive: %v", err)
+	}
+
+	findings := []finding{
+		{RuleID: "password", StartLine: 2, EndLine: 2, Secret: "s3cr3t", File: testFilePath + "!etc/app.conf", ID: "id-1"},
+		{RuleID: "token", Secret: "ELF", File: testFilePath + "!bin/tool", ID: "id-2"},
+	}
+	masker := NewMasker(tmpDir, tmpDir, findings, MaskerOptions{PlaceholderMask: "<%[2]s>", Binary: BinaryDelete}, Default())
+	handler, err := masker.ParseFileType(testFilePath, masker.findings[testFilePath])
+	if err != nil {
+		t.Fatalf("ParseFileType failed: %v", err)
+	}
+	if err := handler(); err != nil {
+		t.Fatalf("HandleArchive failed: %v", err)
+	}
+
+	masked, err := os.ReadFile(testFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read masked archive: %v", err)
+	}
+	if !bytes.HasPrefix(masked, []byte{0x1f, 0x8b}) {
+		t.Fatalf("Expected the archive to stay compressed")
+	}
+	originalHeaders, _ := readTarMembers(t, archive)
+	headers, contents := readTarMembers(t, masked)
+
+	// The deleted binary is replaced by its note, all other headers are kept
+	expectedNames := []string{"./etc/app.conf", "./bin/tool.masked.txt", "./README"}
+	if len(headers) != len(expectedNames) {
+		t.Fatalf("Expected %d members, got %d", len(expectedNames), len(headers))
+	}
+	for i, name := range expectedNames {
+		if headers[i].Name != name {
+			t.Errorf("Expected member %d to be %s, got %s", i, name, headers[i].Name)
+		}
+	}
+	for i, j := range map[int]int{0: 0, 2: 2} {
+		h, o := headers[i], originalHeaders[j]
+		if h.Mode != o.Mode || h.Uid != o.Uid || h.Uname != o.Uname || !h.ModTime.Equal(o.ModTime) {
+			t.Errorf("Expected %s to keep its header", h.Name)
+		}
+	}
+
+	if expected := "user=admin\npassword=<password>\n"; string(contents["etc/app.conf"]) != expected {
+		t.Errorf("Expected masked config %q, got %q", expected, contents["etc/app.conf"])
+	}
+	if !bytes.Contains(contents["bin/tool.masked.txt"], []byte("This file was deleted")) {
+		t.Errorf("Expected note for the deleted binary, got %q", contents["bin/tool.masked.txt"])
+	}
+
+	leaks, err := verifyTree(tmpDir, tmpDir, findings[:1], Policies{}, MatchGlobal, BinaryDelete, Default())
+	if err != nil || len(leaks) != 0 {
+		t.Errorf("Expected no leaks, got %v (%v)", leaks, err)
+	}
+}
+
+func TestMasker_HandleArchive_Image(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	layer := buildTar(t, []tarMember{
+		{name: "app/config.env", mode: 0644, content: []byte("API_KEY=s3cr3t-key\n")},
+	}, true)
+	layerDigest := sha256Hex(layer)
+	diff, err := diffID(layer)
+	if err != nil {
+		t.Fatalf("Failed to compute diff ID: %v", err)
+	}
+	config := fmt.Appendf(nil, `{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:%s"]}}`, diff)
+	configDigest := sha256Hex(config)
+	manifest := fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:%s","size":%d},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:%s","size":%d}]}`,
+		configDigest, len(config), layerDigest, len(layer))
+	manifestDigest := sha256Hex(manifest)
+	index := fmt.Appendf(nil, `{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:%s","size":%d}]}`+"\n",
+		manifestDigest, len(manifest))
+	dockerManifest := fmt.Appendf(nil, `[{"Config":"blobs/sha256/%s","RepoTags":["app:latest"],"Layers":["blobs/sha256/%s"]}]`+"\n", configDigest, layerDigest)
+
+	image := buildTar(t, []tarMember{
+		{name: "blobs/sha256/" + configDigest, mode: 0644, content: config},
+		{name: "blobs/sha256/" + layerDigest, mode: 0644, content: layer},
+		{name: "blobs/sha256/" + manifestDigest, mode: 0644, content: manifest},
+		{name: "index.json", mode: 0644, content: index},
+		{name: "manifest.json", mode: 0644, content: dockerManifest},
+		{name: "oci-layout", mode: 0644, content: []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+	}, false)
+	testFilePath := filepath.Join(tmpDir, "app.tar")
+	if err := os.WriteFile(testFilePath, image, 0600); err != nil {
+		t.Fatalf("Failed to write test image: %v", err)
+	}
+
+	findings := []finding{
+		{RuleID: "api-key", StartLine: 1, EndLine: 1, Secret: "s3cr3t-key", File: testFilePath + "!blobs/sha256/" + layerDigest + "!app/config.env", ID: "id-1"},
+	}
+	masker := NewMasker(tmpDir, tmpDir, findings, MaskerOptions{PlaceholderMask: "<%[2]s>"}, Default())
+	handler, err := masker.ParseFileType(testFilePath, masker.findings[testFilePath])
+	if err != nil {
+		t.Fatalf("ParseFileType failed: %v", err)
+	}
+	if err := handler(); err != nil {
+		t.Fatalf("HandleArchive failed: %v", err)
+	}
+
+	masked, err := os.ReadFile(testFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read masked image: %v", err)
+	}
+	_, contents := readTarMembers(t, masked)
+
+	// Every blob is named after its digest
+	for name, content := range contents {
+		if ociBlobPattern.MatchString(name) && name != "blobs/sha256/"+sha256Hex(content) {
+			t.Errorf("Expected blob %s to be named after its digest %s", name, sha256Hex(content))
+		}
+	}
+
+	var idx struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+			Size   int    `json:"size"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(contents["index.json"], &idx); err != nil || len(idx.Manifests) != 1 {
+		t.Fatalf("Expected index with one manifest, got %s (%v)", contents["index.json"], err)
+	}
+	newManifest := contents["blobs/sha256/"+idx.Manifests[0].Digest[len("sha256:"):]]
+	if newManifest == nil || len(newManifest) != idx.Manifests[0].Size {
+		t.Fatalf("Expected the index to point to the new manifest, got %v", idx.Manifests[0])
+	}
+
+	var m struct {
+		Config struct {
+			Digest string `json:"digest"`
+			Size   int    `json:"size"`
+		} `json:"config"`
+		Layers []struct {
+			Digest string `json:"digest"`
+			Size   int    `json:"size"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(newManifest, &m); err != nil || len(m.Layers) != 1 {
+		t.Fatalf("Expected manifest with one layer, got %s (%v)", newManifest, err)
+	}
+	newLayer := contents["blobs/sha256/"+m.Layers[0].Digest[len("sha256:"):]]
+	if newLayer == nil || len(newLayer) != m.Layers[0].Size || m.Layers[0].Digest == "sha256:"+layerDigest {
+		t.Fatalf("Expected the manifest to point to the new layer, got %v", m.Layers[0])
+	}
+	newConfig := contents["blobs/sha256/"+m.Config.Digest[len("sha256:"):]]
+	if newConfig == nil || len(newConfig) != m.Config.Size {
+		t.Fatalf("Expected the manifest to point to the new config, got %v", m.Config)
+	}
+
+	newDiff, _ := diffID(newLayer)
+	if !bytes.Contains(newConfig, []byte("sha256:"+newDiff)) {
+		t.Errorf("Expected the config to list the new diff ID %s, got %s", newDiff, newConfig)
+	}
+	if !bytes.Contains(contents["manifest.json"], []byte(m.Layers[0].Digest[len("sha256:"):])) ||
+		!bytes.Contains(contents["manifest.json"], []byte(m.Config.Digest[len("sha256:"):])) {
+		t.Errorf("Expected manifest.json to point to the new blobs, got %s", contents["manifest.json"])
+	}
+
+	_, layerContents := readTarMembers(t, newLayer)
+	if expected := "API_KEY=<api-key>\n"; string(layerContents["app/config.env"]) != expected {
+		t.Errorf("Expected masked layer member %q, got %q", expected, layerContents["app/config.env"])
+	}
+
+	leaks, err := verifyTree(tmpDir, tmpDir, findings, Policies{}, MatchGlobal, BinaryTruncate, Default())
+	if err != nil || len(leaks) != 0 {
+		t.Errorf("Expected no leaks, got %v (%v)", leaks, err)
+	}
+}
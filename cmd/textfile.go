@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+)
+
+// utf8BOM is the byte order mark some editors write at the start of UTF-8 files
+const utf8BOM = "\xef\xbb\xbf"
+
+// lineEnding is the line ending convention of a text file
+type lineEnding int
+
+const (
+	// eolNone is a file without line breaks
+	eolNone lineEnding = iota
+	// eolLF is a file with Unix line endings
+	eolLF
+	// eolCRLF is a file with Windows line endings
+	eolCRLF
+	// eolMixed is a file with both
+	eolMixed
+)
+
+// String returns the string representation of the line ending
+func (le lineEnding) String() string {
+	switch le {
+	case eolNone:
+		return "none"
+	case eolLF:
+		return "LF"
+	case eolCRLF:
+		return "CRLF"
+	case eolMixed:
+		return "mixed"
+	default:
+		return "unknown"
+	}
+}
+
+// textLayout describes the bytes of a text file that must survive masking unchanged
+// besides its content: the byte order mark and the line endings
+type textLayout struct {
+	bom bool
+	eol lineEnding
+}
+
+// detectLayout detects the byte order mark and line endings of a text file
+func detectLayout(text string) textLayout {
+	layout := textLayout{bom: strings.HasPrefix(text, utf8BOM)}
+
+	crlf := strings.Count(text, "\r\n")
+	lf := strings.Count(text, "\n") - crlf
+	switch {
+	case crlf > 0 && lf > 0:
+		layout.eol = eolMixed
+	case crlf > 0:
+		layout.eol = eolCRLF
+	case lf > 0:
+		layout.eol = eolLF
+	}
+	return layout
+}
+
+// splitBOM returns the text without its byte order mark, so line and column
+// numbers reported by scanners line up with the content
+func (tl textLayout) splitBOM(text string) string {
+	if tl.bom {
+		return strings.TrimPrefix(text, utf8BOM)
+	}
+	return text
+}
+
+// joinBOM restores the byte order mark removed by splitBOM
+func (tl textLayout) joinBOM(text string) string {
+	if tl.bom {
+		return utf8BOM + text
+	}
+	return text
+}
+
+// adaptSecret returns the multi-line secret with the line endings used in the text.
+// Scanners and report formats do not agree on whether multi-line secrets of
+// CRLF files keep their carriage returns.
+func (tl textLayout) adaptSecret(text, secret string) string {
+	if tl.eol == eolNone || tl.eol == eolLF || !strings.Contains(secret, "\n") || strings.Contains(text, secret) {
+		return secret
+	}
+	crlf := strings.ReplaceAll(strings.ReplaceAll(secret, "\r\n", "\n"), "\n", "\r\n")
+	if strings.Contains(text, crlf) {
+		return crlf
+	}
+	return secret
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	vaultVersion = 1
+	vaultKDF     = "scrypt"
+	vaultAAD     = "credential-masker-vault-v1"
+)
+
+// vaultEntry maps a placeholder written into a file back to the original secret
+type vaultEntry struct {
+	ID          string `json:"id"`          // ID of the finding
+	RuleID      string `json:"ruleID"`      // ID of the rule that triggered the finding
+	File        string `json:"file"`        // Path relative to the target directory, with forward slashes
+	Placeholder string `json:"placeholder"` // Placeholder written into the file
+	Secret      string `json:"secret"`      // Original secret
+}
+
+// vaultFile is the on-disk format of the vault. Only the entries are encrypted.
+type vaultFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// vaultKeyMaterial returns the secret the vault key is derived from, read from the
+// key file if one is given and the passphrase otherwise
+func vaultKeyMaterial(passphrase, keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		material, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading vault key file: %v", err)
+		}
+		if len(material) == 0 {
+			return nil, fmt.Errorf("vault key file %s is empty", keyFile)
+		}
+		return material, nil
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("missing vault passphrase or key file")
+	}
+	return []byte(passphrase), nil
+}
+
+// vaultAEAD derives the AES-256-GCM cipher of a vault from the key material
+func vaultAEAD(material []byte, v *vaultFile) (cipher.AEAD, error) {
+	key, err := scrypt.Key(material, v.Salt, v.N, v.R, v.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving vault key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeVault encrypts the entries and writes them to path
+func writeVault(path string, material []byte, entries []vaultEntry) error {
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("error marshalling vault entries: %v", err)
+	}
+
+	v := &vaultFile{Version: vaultVersion, KDF: vaultKDF, Salt: make([]byte, 16), N: 1 << 15, R: 8, P: 1}
+	if _, err := rand.Read(v.Salt); err != nil {
+		return fmt.Errorf("error generating vault salt: %v", err)
+	}
+	aead, err := vaultAEAD(material, v)
+	if err != nil {
+		return err
+	}
+	v.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(v.Nonce); err != nil {
+		return fmt.Errorf("error generating vault nonce: %v", err)
+	}
+	v.Ciphertext = aead.Seal(nil, v.Nonce, plaintext, []byte(vaultAAD))
+
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling vault: %v", err)
+	}
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		return fmt.Errorf("error writing vault: %v", err)
+	}
+	return nil
+}
+
+// readVault reads and decrypts the entries of the vault at path
+func readVault(path string, material []byte) ([]vaultEntry, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault: %v", err)
+	}
+
+	var v vaultFile
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("error parsing vault: %v", err)
+	}
+	if v.Version != vaultVersion || v.KDF != vaultKDF {
+		return nil, fmt.Errorf("unsupported vault version %d with KDF %q", v.Version, v.KDF)
+	}
+
+	aead, err := vaultAEAD(material, &v)
+	if err != nil {
+		return nil, err
+	}
+	if len(v.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid vault nonce")
+	}
+	plaintext, err := aead.Open(nil, v.Nonce, v.Ciphertext, []byte(vaultAAD))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting vault, wrong passphrase or key file?")
+	}
+
+	var entries []vaultEntry
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, fmt.Errorf("error parsing vault entries: %v", err)
+	}
+	return entries, nil
+}
+
+// recordMasked remembers the secret behind a placeholder written into a file
+func (m *Masker) recordMasked(path, placeholder string, f finding) {
+	m.vaultMu.Lock()
+	defer m.vaultMu.Unlock()
+
+	rel := filepath.ToSlash(relativeTo(m.targetDir, path))
+	key := rel + "\x00" + placeholder
+	if existing, ok := m.vault[key]; ok && existing.Secret != f.Secret {
+		m.logger.Warning("Placeholder %q is used for different secrets in %s and cannot be restored unambiguously", placeholder, rel)
+		return
+	}
+	m.vault[key] = vaultEntry{ID: f.ID, RuleID: f.RuleID, File: rel, Placeholder: placeholder, Secret: f.Secret}
+}
+
+// VaultEntries returns the recorded placeholders, sorted by file and placeholder
+func (m *Masker) VaultEntries() []vaultEntry {
+	m.vaultMu.Lock()
+	defer m.vaultMu.Unlock()
+
+	entries := make([]vaultEntry, 0, len(m.vault))
+	for _, e := range m.vault {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].File != entries[j].File {
+			return entries[i].File < entries[j].File
+		}
+		return entries[i].Placeholder < entries[j].Placeholder
+	})
+	return entries
+}
+
+// unmaskTree walks the target directory and restores every placeholder recorded in
+// the vault, including those inside archives. It returns the number of restored
+// placeholders and the entries whose placeholder was not found.
+func unmaskTree(targetDir string, entries []vaultEntry, logger *Logger) (int, []vaultEntry, error) {
+	// Entries are grouped by the file on disk, which is the outermost archive for members
+	byFile := make(map[string][]vaultEntry)
+	for _, e := range entries {
+		file, _ := splitArchivePath(e.File)
+		byFile[file] = append(byFile[file], e)
+	}
+
+	restored := 0
+	found := make(map[string]bool)
+
+	// restore replaces the placeholders of the entries in a file or archive member
+	// and returns its new content, or nil if nothing changed
+	var restore func(rel string, buf []byte, fileEntries []vaultEntry) ([]byte, error)
+	restore = func(rel string, buf []byte, fileEntries []vaultEntry) ([]byte, error) {
+		var own []vaultEntry
+		members := make(map[string][]vaultEntry)
+		for _, e := range fileEntries {
+			switch {
+			case e.File == rel:
+				own = append(own, e)
+			case strings.HasPrefix(e.File, rel+archiveSeparator):
+				name, _ := splitArchivePath(strings.TrimPrefix(e.File, rel+archiveSeparator))
+				members[name] = append(members[name], e)
+			}
+		}
+
+		if len(members) > 0 {
+			return rewriteArchive(rel, buf, func(name string) bool {
+				return len(members[name]) > 0
+			}, func(name string, content []byte) (memberEdit, error) {
+				out, err := restore(rel+archiveSeparator+name, content, members[name])
+				return memberEdit{content: out}, err
+			})
+		}
+		if len(own) == 0 {
+			return nil, nil
+		}
+
+		enc := detectEncoding(buf)
+		if enc == encBinary {
+			logger.Warning("Skipping %s, it is not a text file", rel)
+			return nil, nil
+		}
+		text, err := enc.decode(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// Longer placeholders first, so one placeholder being a prefix of another does no harm
+		sort.Slice(own, func(i, j int) bool {
+			return len(own[i].Placeholder) > len(own[j].Placeholder)
+		})
+		pairs := make([]string, 0, 2*len(own))
+		for _, e := range own {
+			if n := strings.Count(text, e.Placeholder); n > 0 {
+				restored += n
+				found[e.File+"\x00"+e.Placeholder] = true
+				pairs = append(pairs, e.Placeholder, e.Secret)
+			}
+		}
+		if len(pairs) == 0 {
+			return nil, nil
+		}
+
+		logger.Debug("Restoring %d placeholder(s) in %s", len(pairs)/2, rel)
+		return enc.encode(strings.NewReplacer(pairs...).Replace(text))
+	}
+
+	err := filepath.WalkDir(targetDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel := filepath.ToSlash(relativeTo(targetDir, path))
+		fileEntries := byFile[rel]
+		if len(fileEntries) == 0 {
+			return nil
+		}
+
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out, err := restore(rel, buf, fileEntries)
+		if err != nil || out == nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, out, info.Mode().Perm())
+	})
+	if err != nil {
+		return restored, nil, fmt.Errorf("error restoring %s: %v", targetDir, err)
+	}
+
+	var missing []vaultEntry
+	for _, e := range entries {
+		if !found[e.File+"\x00"+e.Placeholder] {
+			missing = append(missing, e)
+		}
+	}
+	return restored, missing, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVault_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.env")
+	original := "user=admin\npassword=secret123\n"
+	if err := os.WriteFile(path, []byte(original), 0640); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	findings := []finding{
+		{RuleID: "password", StartLine: 2, EndLine: 2, Secret: "secret123", File: path, ID: "id-1"},
+	}
+	masker := NewMasker(dir, dir, findings, MaskerOptions{PlaceholderMask: "<%[2]s:%[3]s>"}, Default())
+	buf, _ := os.ReadFile(path)
+	if err := masker.HandleText(buf, path, findings...); err != nil {
+		t.Fatalf("HandleText failed: %v", err)
+	}
+
+	vaultPath := filepath.Join(t.TempDir(), "masked.vault")
+	if err := writeVault(vaultPath, []byte("correct horse"), masker.VaultEntries()); err != nil {
+		t.Fatalf("writeVault failed: %v", err)
+	}
+	if _, err := readVault(vaultPath, []byte("wrong horse")); err == nil {
+		t.Fatal("Expected reading the vault with a wrong passphrase to fail")
+	}
+
+	entries, err := readVault(vaultPath, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("readVault failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].File != "config.env" || entries[0].Placeholder != "<password:id-1>" {
+		t.Fatalf("Unexpected vault entries: %+v", entries)
+	}
+
+	restored, missing, err := unmaskTree(dir, entries, Default())
+	if err != nil {
+		t.Fatalf("unmaskTree failed: %v", err)
+	}
+	if restored != 1 || len(missing) != 0 {
+		t.Errorf("Expected 1 restored and 0 missing placeholders, got %d and %d", restored, len(missing))
+	}
+	content, _ := os.ReadFile(path)
+	if string(content) != original {
+		t.Errorf("Expected content to be restored to\n%s\nbut got\n%s", original, content)
+	}
+}
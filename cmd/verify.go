@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// encodedSecret is one representation a secret can be written in
+type encodedSecret struct {
+	Encoding string // Name of the encoding, "raw" for the secret itself
+	Value    string // Secret in that encoding
+}
+
+// encodedVariants returns the secret and its common encodings, including the text
+// encodings files are masked in, without duplicates.
+// Base64 is searched without padding, so padded and unpadded copies are both found.
+func encodedVariants(secret string) []encodedSecret {
+	quoted, _ := json.Marshal(secret)
+	candidates := []encodedSecret{
+		{Encoding: "raw", Value: secret},
+		{Encoding: "base64", Value: base64.RawStdEncoding.EncodeToString([]byte(secret))},
+		{Encoding: "base64url", Value: base64.RawURLEncoding.EncodeToString([]byte(secret))},
+		{Encoding: "hex", Value: hex.EncodeToString([]byte(secret))},
+		{Encoding: "hex", Value: strings.ToUpper(hex.EncodeToString([]byte(secret)))},
+		{Encoding: "url", Value: url.QueryEscape(secret)},
+		{Encoding: "url", Value: url.PathEscape(secret)},
+		{Encoding: "json", Value: string(quoted[1 : len(quoted)-1])},
+	}
+	for _, te := range []textEncoding{encUTF16LE, encUTF16BE, encWindows1252} {
+		if encoded, err := te.encode(secret); err == nil {
+			candidates = append(candidates, encodedSecret{Encoding: te.name, Value: string(encoded)})
+		}
+	}
+
+	seen := make(map[string]bool)
+	var variants []encodedSecret
+	for _, c := range candidates {
+		if c.Value == "" || seen[c.Value] {
+			continue
+		}
+		seen[c.Value] = true
+		variants = append(variants, c)
+	}
+	return variants
+}
+
+// leak is an occurrence of a secret that survived masking
+type leak struct {
+	File     string // Path relative to the target directory, with forward slashes
+	Line     int    // Line of the occurrence
+	RuleID   string // Rule of the finding whose secret was found
+	Origin   string // Where the finding was reported, as path:line
+	Encoding string // Encoding the secret was found in
+	Object   string // Git object the secret was found in, as type and ID, when verifying history
+}
+
+// String describes the leak without revealing the secret
+func (l leak) String() string {
+	where := l.File
+	if l.Object != "" {
+		where = strings.TrimSpace(l.Object + " " + l.File)
+	}
+	return fmt.Sprintf("%s:%d: %s secret of %s (%s)", where, l.Line, l.RuleID, l.Origin, l.Encoding)
+}
+
+// verifier searches files for the secrets of the findings in all their encodings
+type verifier struct {
+	needles    []needle
+	exempt     map[string]bool                // relative path + secret
+	keepBinary map[string]bool                // relative path + secret
+	positional map[string]map[string][][2]int // Line ranges of the secrets only masked in position mode, by secret and relative path
+	leaks      []leak
+	logger     *Logger
+}
+
+// needle is one encoding of a secret to search for
+type needle struct {
+	encodedSecret
+	secret  string
+	f       finding
+	origin  string
+	pattern *regexp.Regexp // Matches multi-line secrets regardless of line endings and indentation
+}
+
+// newVerifier prepares the search for the secrets of the findings. Secrets of
+// findings skipped by policy, outright or by their verification status, are
+// allowed to remain in the files they were reported in, as are those in binary
+// files kept by the binary strategy. Secrets whose
+// findings are all masked in position mode, by the match mode or their policies,
+// are only searched on the lines they were reported at, since position mode
+// leaves every other occurrence as it is.
+func newVerifier(sourceDir, targetDir string, findings []finding, policies Policies, matchMode MatchMode, binary BinaryStrategy, logger *Logger) *verifier {
+	v := &verifier{exempt: make(map[string]bool), keepBinary: make(map[string]bool), positional: make(map[string]map[string][][2]int), logger: logger}
+	global := make(map[string]bool)
+	seen := make(map[string]bool)
+	unverifiable := 0
+	for _, f := range findings {
+		if f.Secret == "" {
+			unverifiable++
+			continue
+		}
+		rel := filepath.ToSlash(relativeTo(targetDir, targetPath(sourceDir, targetDir, f.File)))
+		p := policies.For(f.RuleID, rel)
+		if p.skips(f) {
+			v.exempt[rel+"\x00"+f.Secret] = true
+			continue
+		}
+		strategy := binary
+		if p.Binary != "" {
+			strategy, _ = ParseBinaryStrategy(p.Binary) // validated when the config is loaded
+		}
+		if strategy == BinaryKeep {
+			v.keepBinary[rel+"\x00"+f.Secret] = true
+		}
+		mode := matchMode
+		if p.MatchMode != "" {
+			mode, _ = ParseMatchMode(p.MatchMode) // validated when the config is loaded
+		}
+		if mode == MatchPosition {
+			if v.positional[f.Secret] == nil {
+				v.positional[f.Secret] = make(map[string][][2]int)
+			}
+			lines := [2]int{1, math.MaxInt} // findings without a line are searched in the whole file
+			if f.StartLine > 0 {
+				lines = [2]int{f.StartLine, max(f.EndLine, f.StartLine)}
+			}
+			v.positional[f.Secret][rel] = append(v.positional[f.Secret][rel], lines)
+		} else {
+			global[f.Secret] = true
+		}
+		if seen[f.Secret] {
+			continue
+		}
+		seen[f.Secret] = true
+		for _, e := range encodedVariants(f.Secret) {
+			n := needle{encodedSecret: e, secret: f.Secret, f: f, origin: fmt.Sprintf("%s:%d", rel, f.StartLine)}
+			if e.Encoding == "raw" && strings.Contains(strings.TrimSpace(f.Secret), "\n") {
+				n.pattern = multilinePattern(f.Secret)
+			}
+			v.needles = append(v.needles, n)
+		}
+	}
+	for secret := range global {
+		delete(v.positional, secret)
+	}
+	if unverifiable > 0 {
+		logger.Warning("%d finding(s) only carry a hashed secret and cannot be verified", unverifiable)
+	}
+	return v
+}
+
+// search looks for the secrets in a file or archive member, and in the members of
+// archives
+func (v *verifier) search(rel string, buf []byte) {
+	text := string(buf)
+	isBinary := detectEncoding(buf) == encBinary
+	for _, n := range v.needles {
+		if v.exempt[rel+"\x00"+n.secret] || isBinary && v.keepBinary[rel+"\x00"+n.secret] {
+			continue
+		}
+		var offsets []int
+		if n.pattern != nil {
+			for _, loc := range n.pattern.FindAllStringIndex(text, -1) {
+				offsets = append(offsets, loc[0])
+			}
+		}
+		for offset := 0; n.pattern == nil; {
+			i := strings.Index(text[offset:], n.Value)
+			if i < 0 {
+				break
+			}
+			offset += i
+			offsets = append(offsets, offset)
+			offset += len(n.Value)
+		}
+		reported, positional := v.positional[n.secret]
+		for _, offset := range offsets {
+			line := strings.Count(text[:offset], "\n") + 1
+			if positional && !slices.ContainsFunc(reported[rel], func(lines [2]int) bool { return line >= lines[0] && line <= lines[1] }) {
+				continue // left as it is by position mode
+			}
+			v.leaks = append(v.leaks, leak{
+				File:     rel,
+				Line:     line,
+				RuleID:   n.f.RuleID,
+				Origin:   n.origin,
+				Encoding: n.Encoding,
+			})
+		}
+	}
+
+	if !isArchiveName(rel) {
+		return
+	}
+	err := walkArchive(rel, buf, func(member string, content []byte) error {
+		v.search(rel+archiveSeparator+member, content)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNotArchive) {
+		v.logger.Warning("Cannot look inside archive %s: %v", rel, err)
+	}
+}
+
+// sortedLeaks returns the leaks found so far, by object, file and line
+func (v *verifier) sortedLeaks() []leak {
+	sort.SliceStable(v.leaks, func(i, j int) bool {
+		a, b := v.leaks[i], v.leaks[j]
+		if a.Object != b.Object {
+			return a.Object < b.Object
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	return v.leaks
+}
+
+// verifyTree re-reads every file of the target directory, and the members of the
+// archives in it, and searches them for the secrets of the findings
+func verifyTree(sourceDir, targetDir string, findings []finding, policies Policies, matchMode MatchMode, binary BinaryStrategy, logger *Logger) ([]leak, error) {
+	v := newVerifier(sourceDir, targetDir, findings, policies, matchMode, binary, logger)
+	err := filepath.WalkDir(targetDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		v.search(filepath.ToSlash(relativeTo(targetDir, path)), buf)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error verifying %s: %v", targetDir, err)
+	}
+	return v.sortedLeaks(), nil
+}
+
+// verifyHistory reads every object reachable from the refs of the rewritten
+// repository in the target directory, and searches every version of every file,
+// notes included, and every commit message and tag annotation for the secrets of
+// the findings
+func verifyHistory(ctx context.Context, sourceDir, targetDir string, findings []finding, policies Policies, binary BinaryStrategy, logger *Logger) ([]leak, error) {
+	objects, err := runGit(ctx, targetDir, "rev-list", "--all", "--objects")
+	if err != nil {
+		return nil, fmt.Errorf("error listing the objects of %s: %v", targetDir, err)
+	}
+	br, err := newBlobReader(ctx, targetDir)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+
+	// History is masked in global mode, reported lines only hold in one commit
+	v := newVerifier(sourceDir, targetDir, findings, policies.globalMatching(), MatchGlobal, binary, logger)
+	for _, line := range strings.Split(objects, "\n") {
+		oid, path, _ := strings.Cut(line, " ")
+		if oid == "" {
+			continue
+		}
+		kind, content, err := br.object(oid)
+		if err != nil {
+			return nil, fmt.Errorf("error verifying %s: %v", targetDir, err)
+		}
+		if kind == "tree" {
+			continue
+		}
+		if kind != "blob" {
+			path = "" // the name of the ref of a tag
+		}
+		from := len(v.leaks)
+		v.search(path, content)
+		for i := from; i < len(v.leaks); i++ {
+			v.leaks[i].Object = kind + " " + oid
+		}
+	}
+	return v.sortedLeaks(), nil
+}
+
+// reportLeaks logs the leaks and returns an error if there are any
+func reportLeaks(leaks []leak, logger *Logger) error {
+	if len(leaks) == 0 {
+		return nil
+	}
+	for _, l := range leaks {
+		logger.Error("Secret survived masking: %s", l)
+	}
+	return fmt.Errorf("verification failed: %d secret occurrence(s) survived masking", len(leaks))
+}
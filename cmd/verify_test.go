@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyTree(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.env":     "password=***MASKED***\n",
+		"docs/setup.md":  "Use the password secret123 locally\n",
+		"deploy/k8s.yml": "data:\n  password: " + base64.StdEncoding.EncodeToString([]byte("secret123")) + "\n",
+		"test/fixture":   "token=s3cr3t-t0k3n\n",
+		"deploy/key.yml": "key: |\r\n  BEGIN KEY\r\n  abc\r\n  END KEY\r\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	findings := []finding{
+		{RuleID: "password", StartLine: 1, Secret: "secret123", File: filepath.Join(dir, "config.env")},
+		{RuleID: "token", StartLine: 1, Secret: "s3cr3t-t0k3n", File: filepath.Join(dir, "test/fixture")},
+		{RuleID: "private-key", StartLine: 3, Secret: "BEGIN KEY\nabc\nEND KEY", File: filepath.Join(dir, "keys/id.txt")},
+		{RuleID: "hashed", StartLine: 1, HashedSecret: "9119d6a820c5bd916857b03a71318176ad57bfb7", File: filepath.Join(dir, "config.env")},
+	}
+	policies := Policies{Paths: map[string]Policy{"test": {Skip: true}}}
+
+	leaks, err := verifyTree(dir, dir, findings, policies, MatchGlobal, BinaryTruncate, Default())
+	if err != nil {
+		t.Fatalf("verifyTree failed: %v", err)
+	}
+
+	expected := []leak{
+		{File: "deploy/k8s.yml", Line: 2, RuleID: "password", Origin: "config.env:1", Encoding: "base64"},
+		{File: "deploy/key.yml", Line: 2, RuleID: "private-key", Origin: "keys/id.txt:3", Encoding: "raw"},
+		{File: "docs/setup.md", Line: 1, RuleID: "password", Origin: "config.env:1", Encoding: "raw"},
+	}
+	if len(leaks) != len(expected) {
+		t.Fatalf("Expected %d leaks, got %d: %v", len(expected), len(leaks), leaks)
+	}
+	for i := range expected {
+		if leaks[i] != expected[i] {
+			t.Errorf("Expected leak %d to be %v, got %v", i, expected[i], leaks[i])
+		}
+	}
+	if err := reportLeaks(leaks, Default()); err == nil {
+		t.Error("Expected reportLeaks to fail")
+	}
+}
+
+func TestVerifyTree_PositionMode(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	app := write("app.conf", "comment=abc123 is the old password\npassword=abc123\n")
+	tokens := write("tokens.conf", "# t0k3n\ntoken=t0k3n\n")
+	findings := []finding{
+		{RuleID: "password", File: app, StartLine: 2, EndLine: 2, Secret: "abc123"},
+		{RuleID: "token", File: tokens, StartLine: 2, EndLine: 2, Secret: "t0k3n"},
+	}
+
+	// Position mode for every finding, or by a rule policy in global mode
+	for _, tt := range []struct {
+		name      string
+		matchMode MatchMode
+		policies  Policies
+	}{
+		{name: "flag", matchMode: MatchPosition},
+		{name: "policy", matchMode: MatchGlobal, policies: Policies{Rules: map[string]Policy{"*": {MatchMode: "position"}}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			write("app.conf", "comment=abc123 is the old password\npassword=abc123\n")
+			write("tokens.conf", "# t0k3n\ntoken=t0k3n\n")
+			masker := NewMasker(dir, dir, findings, MaskerOptions{PlaceholderMask: "<%[2]s>", MatchMode: tt.matchMode, Policies: tt.policies}, Default())
+			masker.Process()
+			if errs := masker.Errors(); len(errs) > 0 {
+				t.Fatalf("Process failed: %v", errs)
+			}
+
+			leaks, err := verifyTree(dir, dir, findings, tt.policies, tt.matchMode, BinaryTruncate, Default())
+			if err != nil {
+				t.Fatalf("verifyTree failed: %v", err)
+			}
+			if len(leaks) != 0 {
+				t.Errorf("Expected the occurrences outside of the reported lines to be allowed, got %v", leaks)
+			}
+		})
+	}
+
+	// A secret left on a reported line is still a leak
+	write("app.conf", "comment=abc123 is the old password\npassword=abc123\n")
+	leaks, err := verifyTree(dir, dir, findings[:1], Policies{}, MatchPosition, BinaryTruncate, Default())
+	if err != nil {
+		t.Fatalf("verifyTree failed: %v", err)
+	}
+	if len(leaks) != 1 || leaks[0].File != "app.conf" || leaks[0].Line != 2 {
+		t.Errorf("Expected a leak on the reported line, got %v", leaks)
+	}
+}
+
+func TestVerifyHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	gitTest(t, ".", "init", "--quiet", dir)
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	write("config.env", "password=secret123\n")
+	gitTest(t, dir, "add", "--all")
+	gitTest(t, dir, "commit", "--quiet", "--message", "Add config")
+	write("config.env", "password=<password>\n")
+	gitTest(t, dir, "commit", "--quiet", "--all", "--message", "Remove secret123")
+	gitTest(t, dir, "tag", "--annotate", "--message", "Release "+base64.StdEncoding.EncodeToString([]byte("secret123")), "v1.0.0")
+	gitTest(t, dir, "notes", "add", "--message", "Rotate secret123", "HEAD")
+
+	findings := []finding{{RuleID: "password", StartLine: 1, Secret: "secret123", File: filepath.Join(dir, "config.env")}}
+	leaks, err := verifyHistory(context.Background(), dir, dir, findings, Policies{}, BinaryTruncate, Default())
+	if err != nil {
+		t.Fatalf("verifyHistory failed: %v", err)
+	}
+
+	// The working tree is masked, but the old version, the message, the tag and the note are not
+	found := make(map[string]int)
+	for _, l := range leaks {
+		kind, _, _ := strings.Cut(l.Object, " ")
+		found[kind+" "+l.File]++
+	}
+	if len(leaks) != 4 || found["blob config.env"] != 1 || found["commit "] != 1 || found["tag "] != 1 {
+		t.Errorf("Expected leaks in a blob, a commit, a tag and a note, got %v", leaks)
+	}
+	if err := reportLeaks(leaks, Default()); err == nil {
+		t.Error("Expected reportLeaks to fail")
+	}
+}
+
+func TestEncodedVariants(t *testing.T) {
+	variants := make(map[string]string)
+	for _, v := range encodedVariants("p@ss/word") {
+		if _, ok := variants[v.Value]; ok {
+			t.Errorf("Duplicate variant %q", v.Value)
+		}
+		variants[v.Value] = v.Encoding
+	}
+
+	for value, encoding := range map[string]string{
+		"p@ss/word":          "raw",
+		"cEBzcy93b3Jk":       "base64",
+		"704073732f776f7264": "hex",
+		"p%40ss%2Fword":      "url",
+	} {
+		if variants[value] != encoding {
+			t.Errorf("Expected %q as %s variant, got %q", value, encoding, variants[value])
+		}
+	}
+}